@@ -4,16 +4,253 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 )
 
 type Config struct {
+	Server     Server `json:"server"`
 	WeatherAPI struct {
 		Key string `json:"key"`
+		// DailyLimit is how many calls a day refreshes may make, defaults to
+		// the free tier's 1,000, negative turns the limit off
+		DailyLimit int `json:"dailyLimit"`
+		// PerMinute spreads the calls out, defaults to 60
+		PerMinute int `json:"perMinute"`
+		// HTTP is how the API is called
+		HTTP HTTPClient `json:"http"`
 	} `json:"weatherAPI"`
+	Geocoding struct {
+		// GeoNamesFile is an optional GeoNames cities dump, when set city
+		// searches are answered locally instead of by the weather API
+		GeoNamesFile string `json:"geonamesFile"`
+		// GeoNamesPostalFile is an optional GeoNames postal code dump used for
+		// postal code searches when GeoNamesFile is set
+		GeoNamesPostalFile string `json:"geonamesPostalFile"`
+		// GeoNamesAdmin1File is an optional GeoNames admin1 codes file, it
+		// names the states the other files only have codes for
+		GeoNamesAdmin1File string `json:"geonamesAdmin1File"`
+		// CacheTTL is how long city search results are kept, defaults to 30 days
+		CacheTTL Duration `json:"cacheTTL"`
+	} `json:"geocoding"`
+	Notifications struct {
+		Sinks []NotificationSink `json:"sinks"`
+		Rules []NotificationRule `json:"rules"`
+	} `json:"notifications"`
+	// Webhooks are sent the location and its conditions after every refresh
+	Webhooks []Webhook `json:"webhooks"`
+	// MQTT publishes conditions to a broker for Home Assistant, it's off
+	// when Broker is empty
+	MQTT struct {
+		// Broker is the broker URL, e.g. "tcp://localhost:1883"
+		Broker   string `json:"broker"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+		ClientID string `json:"clientID"`
+		// TopicPrefix defaults to "personal-weather"
+		TopicPrefix string `json:"topicPrefix"`
+		// DiscoveryPrefix defaults to "homeassistant"
+		DiscoveryPrefix string `json:"discoveryPrefix"`
+	} `json:"mqtt"`
+	Auth struct {
+		// Enabled gives each user their own locations and requires signing in
+		Enabled bool `json:"enabled"`
+		// SessionTTL is how long a sign in lasts, defaults to 30 days
+		SessionTTL Duration `json:"sessionTTL"`
+		// AllowSignup lets anyone who can reach the server create an account
+		AllowSignup bool `json:"allowSignup"`
+		// OIDC adds signing in through an OpenID Connect provider
+		OIDC OIDC `json:"oidc"`
+	} `json:"auth"`
+	// Stations are personal weather stations allowed to upload readings
+	Stations []Station `json:"stations"`
+	Display  struct {
+		// Language picks which local city names to show, e.g. "de" for
+		// "München", empty shows the English names
+		Language string `json:"language"`
+	} `json:"display"`
+}
+
+// Server is where the app listens. Without TLS it serves HTTP on Addr.
+type Server struct {
+	// Addr defaults to ":1117"
+	Addr string `json:"addr"`
+	TLS  TLS    `json:"tls"`
+}
+
+// TLS serves HTTPS with either certificate files or certificates from an ACME
+// CA like Let's Encrypt, it's off while neither is set.
+type TLS struct {
+	// Addr is where HTTPS is served, defaults to ":443"
+	Addr     string `json:"addr"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	ACME     struct {
+		// Domains are the host names certificates are requested for, the CA
+		// has to reach them on ports 80 or 443
+		Domains []string `json:"domains"`
+		// Email is given to the CA for expiry notices
+		Email string `json:"email"`
+		// CacheDir keeps the account key and certificates, defaults to "certs"
+		CacheDir string `json:"cacheDir"`
+		// DirectoryURL is the CA, defaults to Let's Encrypt production
+		DirectoryURL string `json:"directoryURL"`
+	} `json:"acme"`
+	// RedirectAddr, e.g. ":80", serves plain HTTP that redirects to HTTPS and
+	// answers ACME HTTP challenges
+	RedirectAddr string `json:"redirectAddr"`
+}
+
+// Enabled is whether HTTPS is configured.
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" || len(t.ACME.Domains) > 0
+}
+
+// HTTPClient tunes the calls to a provider's API. Network errors, 429s and
+// 5xxs are retried with exponential backoff, and a run of failed calls pauses
+// the calls for a while.
+type HTTPClient struct {
+	// Timeout is per attempt, defaults to 5s
+	Timeout Duration `json:"timeout"`
+	// Retries is how many times a failed call is tried again, defaults to 2,
+	// negative turns retrying off
+	Retries int `json:"retries"`
+	// Backoff is the wait before the first retry, defaults to 500ms, it
+	// doubles after each one with some jitter
+	Backoff Duration `json:"backoff"`
+	// MaxBackoff caps the wait, a Retry-After longer than it isn't waited
+	// for, defaults to 10s
+	MaxBackoff Duration `json:"maxBackoff"`
+	// BreakerFailures is how many failed calls in a row pause the calls,
+	// defaults to 5, negative never pauses them
+	BreakerFailures int `json:"breakerFailures"`
+	// BreakerCooldown is how long the calls are paused, defaults to 1m
+	BreakerCooldown Duration `json:"breakerCooldown"`
+}
+
+func (h *HTTPClient) setDefaults() {
+	if h.Timeout.Duration == 0 {
+		h.Timeout.Duration = 5 * time.Second
+	}
+	if h.Retries == 0 {
+		h.Retries = 2
+	}
+	if h.Backoff.Duration == 0 {
+		h.Backoff.Duration = 500 * time.Millisecond
+	}
+	if h.MaxBackoff.Duration == 0 {
+		h.MaxBackoff.Duration = 10 * time.Second
+	}
+	if h.BreakerFailures == 0 {
+		h.BreakerFailures = 5
+	}
+	if h.BreakerCooldown.Duration == 0 {
+		h.BreakerCooldown.Duration = time.Minute
+	}
+}
+
+// OIDC is an OpenID Connect provider users can sign in with, it's off while
+// Issuer is empty.
+type OIDC struct {
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"clientID"`
+	ClientSecret string `json:"clientSecret"`
+	// RedirectURL is this server's /auth/oidc/callback as the provider reaches it
+	RedirectURL string `json:"redirectURL"`
+	// Label names the provider on the sign in button, defaults to "SSO"
+	Label string `json:"label"`
+	// DisableUserCreation stops new users being made for unknown identities,
+	// they then have to be linked by a signed in user first
+	DisableUserCreation bool `json:"disableUserCreation"`
+}
+
+// NotificationSink is somewhere notifications are sent. Type is "smtp",
+// "webhook", "ntfy" or "gotify", the other fields are used by the types that
+// need them.
+type NotificationSink struct {
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	Host     string            `json:"host"`
+	Port     int               `json:"port"`
+	Username string            `json:"username"`
+	Password string            `json:"password"`
+	From     string            `json:"from"`
+	To       []string          `json:"to"`
+	URL      string            `json:"url"`
+	Token    string            `json:"token"`
+	Priority int               `json:"priority"`
+	Headers  map[string]string `json:"headers"`
+}
+
+// NotificationRule is when to send a notification. Type is "threshold",
+// "alert", or the "temperature_below" and "temperature_above" shorthands.
+type NotificationRule struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Location string `json:"location"`
+	// Metric is "temperature", "feels_like", "humidity", "pressure" or "wind_speed"
+	Metric string `json:"metric"`
+	// Operator is "<", "<=", ">" or ">="
+	Operator   string  `json:"operator"`
+	Threshold  float64 `json:"threshold"`
+	Hysteresis float64 `json:"hysteresis"`
+	// Unit of Threshold and Hysteresis, e.g. "F", "C", "mph", "km/h", "inHg"
+	Unit        string   `json:"unit"`
+	For         Duration `json:"for"`
+	Sinks       []string `json:"sinks"`
+	MinInterval Duration `json:"minInterval"`
+	QuietHours  struct {
+		Start string `json:"start"`
+		End   string `json:"end"`
+	} `json:"quietHours"`
+}
+
+// Webhook is a URL that is POSTed the conditions of every refreshed location.
+// When Secret is set the body is signed with HMAC-SHA256.
+type Webhook struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+	// MaxAttempts is how many times a delivery is tried, defaults to 5
+	MaxAttempts int `json:"maxAttempts"`
+}
+
+// Station is a personal weather station. Weather Underground compatible
+// stations upload with ID and Password, Ecowitt stations with their Passkey.
+type Station struct {
+	ID        string  `json:"id"`
+	Password  string  `json:"password"`
+	Passkey   string  `json:"passkey"`
+	Name      string  `json:"name"`
+	State     string  `json:"state"`
+	Country   string  `json:"country"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Duration is a time.Duration written in the config as a string like "30m" or "720h"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30m\": %w", err)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
 }
 
 func (c *Config) String() string {
-	return fmt.Sprintf("conf loaded key size: '%d'", len(c.WeatherAPI.Key))
+	return fmt.Sprintf("conf loaded key size: '%d' geonames file: '%s'", len(c.WeatherAPI.Key), c.Geocoding.GeoNamesFile)
 }
 
 func LoadConfig(fileLocation string) (*Config, error) {
@@ -30,5 +267,36 @@ func LoadConfigFile(f1 *os.File) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if conf.WeatherAPI.DailyLimit == 0 {
+		conf.WeatherAPI.DailyLimit = 1000
+	}
+	if conf.WeatherAPI.PerMinute == 0 {
+		conf.WeatherAPI.PerMinute = 60
+	}
+	conf.WeatherAPI.HTTP.setDefaults()
+	if conf.Server.Addr == "" {
+		conf.Server.Addr = ":1117"
+	}
+	if conf.Server.TLS.Addr == "" {
+		conf.Server.TLS.Addr = ":443"
+	}
+	if conf.Server.TLS.ACME.CacheDir == "" {
+		conf.Server.TLS.ACME.CacheDir = "certs"
+	}
+	if conf.Server.TLS.CertFile != "" && len(conf.Server.TLS.ACME.Domains) > 0 {
+		return nil, fmt.Errorf("server.tls: set either certFile and keyFile or acme, not both")
+	}
+	if (conf.Server.TLS.CertFile == "") != (conf.Server.TLS.KeyFile == "") {
+		return nil, fmt.Errorf("server.tls: certFile and keyFile go together")
+	}
+	if conf.Geocoding.CacheTTL.Duration == 0 {
+		conf.Geocoding.CacheTTL.Duration = 30 * 24 * time.Hour
+	}
+	if conf.Auth.SessionTTL.Duration == 0 {
+		conf.Auth.SessionTTL.Duration = 30 * 24 * time.Hour
+	}
+	if conf.Auth.OIDC.Label == "" {
+		conf.Auth.OIDC.Label = "SSO"
+	}
 	return conf, nil
 }
@@ -0,0 +1,23 @@
+// Package context carries request scoped values, like the signed in user,
+// from middleware to handlers and templates.
+package context
+
+import (
+	"context"
+
+	"github.com/daniel-z-johnson/personal-weather/models"
+)
+
+type key string
+
+const userKey key = "user"
+
+func WithUser(ctx context.Context, user *models.User) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// User is nil when nobody is signed in.
+func User(ctx context.Context) *models.User {
+	user, _ := ctx.Value(userKey).(*models.User)
+	return user
+}
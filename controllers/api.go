@@ -0,0 +1,170 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/daniel-z-johnson/personal-weather/models"
+	"github.com/daniel-z-johnson/personal-weather/units"
+	"github.com/go-chi/chi/v5"
+)
+
+type Measurement struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+type APILocation struct {
+	ID          int         `json:"id"`
+	City        string      `json:"city"`
+	State       string      `json:"state"`
+	Country     string      `json:"country"`
+	Latitude    float64     `json:"latitude"`
+	Longitude   float64     `json:"longitude"`
+	Provider    string      `json:"provider"`
+	Temperature Measurement `json:"temperature"`
+	FeelsLike   Measurement `json:"feelsLike"`
+	Humidity    Measurement `json:"humidity"`
+	WindSpeed   Measurement `json:"windSpeed"`
+	Pressure    Measurement `json:"pressure"`
+	ObservedAt  *time.Time  `json:"observedAt"`
+}
+
+// APILocations lists saved locations as JSON. Units follow the preferences
+// cookie and can be overridden with the same query parameters the settings
+// form uses, e.g. /api/locations?temperature=C&wind=km/h. Like the JSON routes
+// that add and delete locations it's only routed behind RequireScope, so with
+// authentication on it needs a session or an API token.
+func (weather *Weather) APILocations(w http.ResponseWriter, r *http.Request) {
+	allLocations, err := weather.weatherSerivce.GetAll(r.Context(), currentUserID(r))
+	if err != nil {
+		weather.logger.Error("Failed to get all locations for API", slog.Any("error", err))
+		writeJSONError(w, http.StatusInternalServerError, "server issue try again later")
+		return
+	}
+	prefs := apiPreferences(r)
+	locations := make([]APILocation, 0, len(allLocations))
+	for _, v := range allLocations {
+		locations = append(locations, newAPILocation(v, prefs, weather.Language))
+	}
+	writeJSON(w, http.StatusOK, locations)
+}
+
+// APINewLocation is the body of POST /api/locations.
+type APINewLocation struct {
+	City       string            `json:"city"`
+	State      string            `json:"state"`
+	Country    string            `json:"country"`
+	Latitude   float64           `json:"latitude"`
+	Longitude  float64           `json:"longitude"`
+	LocalNames map[string]string `json:"localNames"`
+}
+
+// APIAddLocation saves a location, its conditions are fetched on the next
+// refresh unless another user's location at the same coordinates has them.
+func (weather *Weather) APIAddLocation(w http.ResponseWriter, r *http.Request) {
+	var newLocation APINewLocation
+	if err := json.NewDecoder(r.Body).Decode(&newLocation); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "body must be a JSON location")
+		return
+	}
+	if newLocation.City == "" {
+		writeJSONError(w, http.StatusBadRequest, "city is required")
+		return
+	}
+	if newLocation.Latitude < -90 || newLocation.Latitude > 90 || newLocation.Longitude < -180 || newLocation.Longitude > 180 {
+		writeJSONError(w, http.StatusBadRequest, "latitude must be between -90 and 90 and longitude between -180 and 180")
+		return
+	}
+	if newLocation.LocalNames == nil {
+		newLocation.LocalNames = make(map[string]string)
+	}
+	id, err := weather.weatherSerivce.SaveLocation(r.Context(), currentUserID(r), newLocation.City, newLocation.State, newLocation.Country,
+		newLocation.Latitude, newLocation.Longitude, newLocation.LocalNames)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "server issue try again later")
+		return
+	}
+	location, err := weather.weatherSerivce.GetLocationByID(r.Context(), id)
+	if err != nil || location == nil {
+		writeJSONError(w, http.StatusInternalServerError, "server issue try again later")
+		return
+	}
+	writeJSON(w, http.StatusCreated, newAPILocation(*location, apiPreferences(r), weather.Language))
+}
+
+func (weather *Weather) APIDeleteLocation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid location id")
+		return
+	}
+	if err := weather.weatherSerivce.DeleteLocation(r.Context(), currentUserID(r), id); err != nil {
+		if errors.Is(err, models.ErrLocationNotFound) {
+			writeJSONError(w, http.StatusNotFound, "location not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "server issue try again later")
+		return
+	}
+	weather.locationDeleted(r.Context(), id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newAPILocation(v models.Location, prefs units.Preferences, language string) APILocation {
+	tempUnit := prefs.TemperatureUnit()
+	location := APILocation{
+		ID:        v.ID,
+		City:      v.DisplayName(language),
+		State:     v.State,
+		Country:   v.Country,
+		Latitude:  v.Latitude,
+		Longitude: v.Longitude,
+		Provider:  v.Provider,
+		Temperature: Measurement{
+			Value: prefs.Round(v.Temperature.In(tempUnit)),
+			Unit:  string(tempUnit),
+		},
+		FeelsLike: Measurement{
+			Value: prefs.Round(v.FeelsLike.In(tempUnit)),
+			Unit:  string(tempUnit),
+		},
+		Humidity: Measurement{Value: v.Humidity, Unit: "%"},
+		WindSpeed: Measurement{
+			Value: prefs.Round(units.ConvertSpeed(v.WindSpeed, units.MetersPerSecond, prefs.Wind)),
+			Unit:  string(prefs.Wind),
+		},
+		Pressure: Measurement{
+			Value: prefs.Round(units.ConvertPressure(v.Pressure, units.Hectopascals, prefs.Pressure)),
+			Unit:  string(prefs.Pressure),
+		},
+	}
+	if !v.ObservedAt.IsZero() {
+		location.ObservedAt = &v.ObservedAt
+	}
+	return location
+}
+
+// apiPreferences starts from the cookie preferences and lets query parameters
+// override them
+func apiPreferences(r *http.Request) units.Preferences {
+	values := preferencesFromRequest(r).Values()
+	for key, value := range r.URL.Query() {
+		values[key] = value
+	}
+	return units.ParsePreferences(values)
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/daniel-z-johnson/personal-weather/models"
+)
+
+type Notifications struct {
+	logger    *slog.Logger
+	notifier  *models.Notifier
+	Templates struct {
+		Notifications Template
+	}
+}
+
+func NewNotifications(logger *slog.Logger, notifier *models.Notifier) (*Notifications, error) {
+	return &Notifications{logger: logger, notifier: notifier}, nil
+}
+
+type notificationsPageData struct {
+	Sinks []string
+	Rules []RuleData
+	Sent  string
+}
+
+type RuleData struct {
+	Name       string
+	Kind       string
+	Location   string
+	Condition  string
+	QuietHours string
+	Sinks      string
+	// States are the places the rule is pending or firing for
+	States []string
+}
+
+func (notifications *Notifications) Notifications(w http.ResponseWriter, r *http.Request) {
+	notifications.Templates.Notifications.Execute(w, r, notifications.pageData(r.Context()))
+}
+
+// SendTest sends a test notification to the sink picked on the page.
+func (notifications *Notifications) SendTest(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		notifications.logger.Error("Failed to parse form", slog.Any("error", err))
+		notifications.Templates.Notifications.Execute(w, r, notifications.pageData(r.Context()), fmt.Errorf("Server issue try again later"))
+		return
+	}
+	sink := r.FormValue("sink")
+	data := notifications.pageData(r.Context())
+	if err := notifications.notifier.SendTest(r.Context(), sink); err != nil {
+		notifications.Templates.Notifications.Execute(w, r, data, fmt.Errorf("Test notification to %s failed: %v", sink, err))
+		return
+	}
+	data.Sent = sink
+	notifications.Templates.Notifications.Execute(w, r, data)
+}
+
+func (notifications *Notifications) pageData(ctx context.Context) *notificationsPageData {
+	data := &notificationsPageData{}
+	for name := range notifications.notifier.Sinks {
+		data.Sinks = append(data.Sinks, name)
+	}
+	slices.Sort(data.Sinks)
+	var states []models.RuleState
+	if notifications.notifier.Evaluator != nil {
+		var err error
+		if states, err = notifications.notifier.Evaluator.States(ctx); err != nil {
+			// the page is still useful without them
+			notifications.logger.Error("Failed to get rule states", slog.Any("error", err))
+		}
+	}
+	for _, rule := range notifications.notifier.Rules {
+		location := rule.Location
+		if location == "" {
+			location = "All locations"
+		}
+		ruleData := RuleData{
+			Name:       rule.Name,
+			Kind:       rule.Kind,
+			Location:   location,
+			QuietHours: rule.QuietHours.String(),
+			Sinks:      strings.Join(rule.Sinks, ", "),
+		}
+		if rule.Kind == models.RuleThreshold {
+			ruleData.Condition = rule.Condition.String()
+		}
+		for _, state := range states {
+			if state.Rule == rule.Name && state.State != "clear" {
+				ruleData.States = append(ruleData.States, fmt.Sprintf("%s for %s (%.4f, %.4f) since %s",
+					state.State, state.City, state.Latitude, state.Longitude, state.Since.Format(time.DateTime)))
+			}
+		}
+		data.Rules = append(data.Rules, ruleData)
+	}
+	return data
+}
@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/daniel-z-johnson/personal-weather/context"
+	"github.com/daniel-z-johnson/personal-weather/models"
+	"golang.org/x/oauth2"
+)
+
+const oidcCookie = "oidc"
+
+// OIDC signs users in through an OpenID Connect provider with the
+// authorization code flow and PKCE.
+type OIDC struct {
+	logger       *slog.Logger
+	users        *Users
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// CreateUsers makes a local user for anyone the provider signs in,
+	// otherwise identities have to be linked by a signed in user first
+	CreateUsers bool
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+func NewOIDC(logger *slog.Logger, users *Users) (*OIDC, error) {
+	return &OIDC{logger: logger, users: users}, nil
+}
+
+// discover fetches the provider's configuration the first time it's needed,
+// so the app still starts while the provider is down.
+func (o *OIDC) discover(r *http.Request) (*oidc.Provider, *oauth2.Config, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.provider == nil {
+		provider, err := oidc.NewProvider(r.Context(), o.Issuer)
+		if err != nil {
+			o.logger.Error("Failed to discover OpenID Connect provider", slog.String("issuer", o.Issuer), slog.Any("error", err))
+			return nil, nil, err
+		}
+		o.provider = provider
+	}
+	config := &oauth2.Config{
+		ClientID:     o.ClientID,
+		ClientSecret: o.ClientSecret,
+		RedirectURL:  o.RedirectURL,
+		Endpoint:     o.provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+	return o.provider, config, nil
+}
+
+// Start sends the browser to the provider. The state, nonce and PKCE verifier
+// wait in a short lived cookie for the callback.
+func (o *OIDC) Start(w http.ResponseWriter, r *http.Request) {
+	_, config, err := o.discover(r)
+	if err != nil {
+		o.users.Templates.SignIn.Execute(w, r, o.users.signInPage("", "/"), fmt.Errorf("Single sign-on is unavailable, try again later"))
+		return
+	}
+	state := rand.Text()
+	nonce := rand.Text()
+	verifier := oauth2.GenerateVerifier()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    strings.Join([]string{state, nonce, verifier, safeNext(r.URL.Query().Get("next"))}, "|"),
+		Path:     "/auth/oidc",
+		Expires:  time.Now().Add(10 * time.Minute),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// the provider redirects back with a top level GET, which Lax allows
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), http.StatusFound)
+}
+
+// Callback finishes signing in. A user who is already signed in links the
+// identity to their account instead.
+func (o *OIDC) Callback(w http.ResponseWriter, r *http.Request) {
+	fail := func(message string, err error, attrs ...any) {
+		o.logger.Warn("Single sign-on failed", append(attrs, slog.Any("error", err))...)
+		o.users.Templates.SignIn.Execute(w, r, o.users.signInPage("", "/"), errors.New(message))
+	}
+	cookie, err := r.Cookie(oidcCookie)
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Value: "", Path: "/auth/oidc", MaxAge: -1, HttpOnly: true})
+	if err != nil {
+		fail("Single sign-on took too long, try again", err)
+		return
+	}
+	parts := strings.SplitN(cookie.Value, "|", 4)
+	if len(parts) != 4 {
+		fail("Single sign-on failed, try again", errors.New("malformed state cookie"))
+		return
+	}
+	state, nonce, verifier, next := parts[0], parts[1], parts[2], parts[3]
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		fail("The identity provider refused to sign you in", errors.New(providerErr),
+			slog.String("description", query.Get("error_description")))
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+		fail("Single sign-on failed, try again", errors.New("state mismatch"))
+		return
+	}
+	provider, config, err := o.discover(r)
+	if err != nil {
+		fail("Single sign-on is unavailable, try again later", err)
+		return
+	}
+	token, err := config.Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		fail("Single sign-on failed, try again", err)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		fail("Single sign-on failed, try again", errors.New("no id_token in token response"))
+		return
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: o.ClientID}).Verify(r.Context(), rawIDToken)
+	if err != nil {
+		fail("Single sign-on failed, try again", err)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		fail("Single sign-on failed, try again", errors.New("nonce mismatch"))
+		return
+	}
+	var claims struct {
+		Email             string `json:"email"`
+		PreferredUsername string `json:"preferred_username"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		fail("Single sign-on failed, try again", err)
+		return
+	}
+	identity := models.Identity{Issuer: idToken.Issuer, Subject: idToken.Subject, Email: claims.Email, Username: claims.PreferredUsername}
+	user, err := o.users.userService.UserForIdentity(r.Context(), identity, context.User(r.Context()), o.CreateUsers)
+	if err != nil {
+		if errors.Is(err, models.ErrUnknownIdentity) {
+			fail("There's no account for you yet, sign in with a password and use single sign-on to link it", err,
+				slog.String("subject", identity.Subject))
+			return
+		}
+		fail("Server issue try again later", err)
+		return
+	}
+	o.users.startSession(w, r, user, next)
+}
@@ -0,0 +1,375 @@
+package controllers
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daniel-z-johnson/personal-weather/context"
+	"github.com/daniel-z-johnson/personal-weather/models"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pressly/goose/v3"
+)
+
+// openTestDB is a migrated database that's removed after the test.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "w.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	goose.SetLogger(goose.NopLogger())
+	if err := goose.SetDialect("sqlite3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := goose.Up(db, "../migrations"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// recordingTemplate keeps the errors of the last page it rendered.
+type recordingTemplate struct {
+	errs []error
+}
+
+func (rt *recordingTemplate) Execute(w http.ResponseWriter, r *http.Request, data any, errs ...error) {
+	rt.errs = errs
+	w.WriteHeader(http.StatusOK)
+}
+
+// authorization is what the mock issuer remembers about a code it handed out.
+type authorization struct {
+	subject   string
+	nonce     string
+	challenge string
+}
+
+// mockIssuer is an OpenID Connect provider serving discovery, its keys and
+// a token endpoint that checks the PKCE verifier.
+type mockIssuer struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+
+	mu        sync.Mutex
+	codes     map[string]authorization
+	verifiers []string
+}
+
+func newMockIssuer(t *testing.T, clientID string) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &mockIssuer{key: key, clientID: clientID, codes: make(map[string]authorization)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                issuer.server.URL,
+			"authorization_endpoint":                issuer.server.URL + "/authorize",
+			"token_endpoint":                        issuer.server.URL + "/token",
+			"jwks_uri":                              issuer.server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "alg": "RS256", "use": "sig", "kid": "test",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", issuer.token)
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+// authorize stands in for the user signing in at the provider, it returns
+// the code the provider redirects back with.
+func (mi *mockIssuer) authorize(subject, nonce, challenge string) string {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	code := rand.Text()
+	mi.codes[code] = authorization{subject: subject, nonce: nonce, challenge: challenge}
+	return code
+}
+
+func (mi *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	mi.mu.Lock()
+	auth, ok := mi.codes[r.PostFormValue("code")]
+	delete(mi.codes, r.PostFormValue("code"))
+	verifier := r.PostFormValue("code_verifier")
+	mi.verifiers = append(mi.verifiers, verifier)
+	mi.mu.Unlock()
+	sum := sha256.Sum256([]byte(verifier))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != auth.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "invalid_grant"}`))
+		return
+	}
+	now := time.Now()
+	idToken := mi.sign(map[string]any{
+		"iss":                mi.server.URL,
+		"sub":                auth.subject,
+		"aud":                mi.clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+		"nonce":              auth.nonce,
+		"email":              auth.subject + "@example.com",
+		"preferred_username": auth.subject,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"access_token": "access", "token_type": "Bearer", "expires_in": 3600, "id_token": idToken})
+}
+
+// sign makes an RS256 JWT of the claims.
+func (mi *mockIssuer) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, mi.key, crypto.SHA256, sum[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+type oidcTest struct {
+	oidc     *OIDC
+	issuer   *mockIssuer
+	users    *models.UserService
+	sessions *models.SessionService
+	signIn   *recordingTemplate
+}
+
+func newOIDCTest(t *testing.T) *oidcTest {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	db := openTestDB(t)
+	tc := &oidcTest{
+		issuer:   newMockIssuer(t, "personal-weather"),
+		users:    &models.UserService{DB: db, Logger: logger},
+		sessions: &models.SessionService{DB: db, Logger: logger, TTL: time.Hour},
+		signIn:   &recordingTemplate{},
+	}
+	usersController, err := NewUsers(logger, tc.users, tc.sessions, &models.APITokenService{DB: db, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersController.Templates.SignIn = tc.signIn
+	tc.oidc, err = NewOIDC(logger, usersController)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.oidc.Issuer = tc.issuer.server.URL
+	tc.oidc.ClientID = "personal-weather"
+	tc.oidc.ClientSecret = "secret"
+	tc.oidc.RedirectURL = "http://weather.example.com/auth/oidc/callback"
+	tc.oidc.CreateUsers = true
+	return tc
+}
+
+// flow changes one step of a sign in to check it's rejected.
+type flow struct {
+	state     string
+	nonce     string
+	challenge string
+	// signedIn is who is already signed in, for linking
+	signedIn *models.User
+}
+
+// run signs subject in through Start, the mock issuer and Callback.
+func (tc *oidcTest) run(t *testing.T, subject string, f flow) *httptest.ResponseRecorder {
+	t.Helper()
+	start := httptest.NewRecorder()
+	tc.oidc.Start(start, httptest.NewRequest(http.MethodGet, "/auth/oidc?next=/manage", nil))
+	if start.Code != http.StatusFound {
+		t.Fatalf("Start responded %d, want a redirect to the provider", start.Code)
+	}
+	location, err := url.Parse(start.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("authorization URL %s doesn't use PKCE", location)
+	}
+	nonce, challenge, state := query.Get("nonce"), query.Get("code_challenge"), query.Get("state")
+	if f.nonce != "" {
+		nonce = f.nonce
+	}
+	if f.challenge != "" {
+		challenge = f.challenge
+	}
+	if f.state != "" {
+		state = f.state
+	}
+	code := tc.issuer.authorize(subject, nonce, challenge)
+	callback := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+	for _, cookie := range start.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+	if f.signedIn != nil {
+		callback = callback.WithContext(context.WithUser(callback.Context(), f.signedIn))
+	}
+	tc.signIn.errs = nil
+	rec := httptest.NewRecorder()
+	tc.oidc.Callback(rec, callback)
+	return rec
+}
+
+// sessionUser is who the session cookie the response set belongs to, nil
+// without one.
+func (tc *oidcTest) sessionUser(t *testing.T, rec *httptest.ResponseRecorder) *models.User {
+	t.Helper()
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == sessionCookie && cookie.Value != "" {
+			user, err := tc.sessions.User(t.Context(), cookie.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return user
+		}
+	}
+	return nil
+}
+
+func (tc *oidcTest) rejected(t *testing.T, rec *httptest.ResponseRecorder, message string) {
+	t.Helper()
+	if user := tc.sessionUser(t, rec); user != nil {
+		t.Errorf("signed in as %s, want the sign in rejected", user.Username)
+	}
+	if len(tc.signIn.errs) != 1 || !strings.Contains(tc.signIn.errs[0].Error(), message) {
+		t.Errorf("sign in page errors = %v, want %q", tc.signIn.errs, message)
+	}
+}
+
+func TestOIDCCreatesUser(t *testing.T) {
+	tc := newOIDCTest(t)
+	rec := tc.run(t, "alice", flow{})
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/manage" {
+		t.Fatalf("Callback responded %d to %q, want a redirect to /manage (errors %v)", rec.Code, rec.Header().Get("Location"), tc.signIn.errs)
+	}
+	user := tc.sessionUser(t, rec)
+	if user == nil || user.Username != "alice" {
+		t.Fatalf("signed in as %v, want a new user alice", user)
+	}
+	again := tc.sessionUser(t, tc.run(t, "alice", flow{}))
+	if again == nil || again.ID != user.ID {
+		t.Errorf("signing in again gave %v, want user %d", again, user.ID)
+	}
+}
+
+func TestOIDCPKCEVerifier(t *testing.T) {
+	tc := newOIDCTest(t)
+	tc.run(t, "alice", flow{})
+	tc.issuer.mu.Lock()
+	verifier := tc.issuer.verifiers[len(tc.issuer.verifiers)-1]
+	tc.issuer.mu.Unlock()
+	if len(verifier) < 43 {
+		t.Errorf("token request sent verifier %q, want the one from Start", verifier)
+	}
+	// the provider saw a different challenge, so the verifier doesn't match it
+	other := sha256.Sum256([]byte("another verifier"))
+	rec := tc.run(t, "bob", flow{challenge: base64.RawURLEncoding.EncodeToString(other[:])})
+	tc.rejected(t, rec, "Single sign-on failed")
+}
+
+func TestOIDCStateMismatch(t *testing.T) {
+	tc := newOIDCTest(t)
+	rec := tc.run(t, "alice", flow{state: "forged"})
+	tc.rejected(t, rec, "Single sign-on failed")
+	if count, _ := tc.users.Count(t.Context()); count != 0 {
+		t.Errorf("%d users were created", count)
+	}
+}
+
+func TestOIDCNonceMismatch(t *testing.T) {
+	tc := newOIDCTest(t)
+	rec := tc.run(t, "alice", flow{nonce: "replayed"})
+	tc.rejected(t, rec, "Single sign-on failed")
+	if count, _ := tc.users.Count(t.Context()); count != 0 {
+		t.Errorf("%d users were created", count)
+	}
+}
+
+func TestOIDCLinksSignedInUser(t *testing.T) {
+	tc := newOIDCTest(t)
+	dan, err := tc.users.Create(t.Context(), "dan", "longenough")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user := tc.sessionUser(t, tc.run(t, "alice", flow{signedIn: dan})); user == nil || user.ID != dan.ID {
+		t.Fatalf("linking signed in as %v, want dan", user)
+	}
+	if user := tc.sessionUser(t, tc.run(t, "alice", flow{})); user == nil || user.ID != dan.ID {
+		t.Errorf("signing in with the linked identity gave %v, want dan", user)
+	}
+	if count, _ := tc.users.Count(t.Context()); count != 1 {
+		t.Errorf("%d users, want only dan", count)
+	}
+}
+
+func TestOIDCDisableUserCreation(t *testing.T) {
+	tc := newOIDCTest(t)
+	tc.oidc.CreateUsers = false
+	rec := tc.run(t, "alice", flow{})
+	tc.rejected(t, rec, "There's no account for you yet")
+	if count, _ := tc.users.Count(t.Context()); count != 0 {
+		t.Errorf("%d users were created", count)
+	}
+	// identities can still be linked by signed in users
+	dan, err := tc.users.Create(t.Context(), "dan", "longenough")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user := tc.sessionUser(t, tc.run(t, "alice", flow{signedIn: dan})); user == nil || user.ID != dan.ID {
+		t.Errorf("linking signed in as %v, want dan", user)
+	}
+}
+
+func TestUserForIdentity(t *testing.T) {
+	db := openTestDB(t)
+	users := &models.UserService{DB: db, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	identity := models.Identity{Issuer: "https://id.example.com", Subject: "1234", Username: "dan"}
+	if _, err := users.UserForIdentity(t.Context(), identity, nil, false); !errors.Is(err, models.ErrUnknownIdentity) {
+		t.Errorf("UserForIdentity without create = %v, want ErrUnknownIdentity", err)
+	}
+	local, err := users.Create(t.Context(), "dan", "longenough")
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := users.UserForIdentity(t.Context(), identity, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == local.ID || created.Username != "dan-2" {
+		t.Errorf("created %+v, want a new user that doesn't take over the local dan", created)
+	}
+	linked, err := users.UserForIdentity(t.Context(), models.Identity{Issuer: identity.Issuer, Subject: "5678"}, local, false)
+	if err != nil || linked.ID != local.ID {
+		t.Errorf("linking gave %v, %v, want the local dan", linked, err)
+	}
+}
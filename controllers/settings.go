@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/daniel-z-johnson/personal-weather/context"
+	"github.com/daniel-z-johnson/personal-weather/models"
+	"github.com/daniel-z-johnson/personal-weather/units"
+)
+
+const preferencesCookie = "preferences"
+
+type Settings struct {
+	logger       *slog.Logger
+	tokenService *models.APITokenService
+	// OIDCLabel offers linking the signed in user to the single sign-on
+	// provider when set
+	OIDCLabel string
+	Templates struct {
+		Settings Template
+	}
+}
+
+func NewSettings(logger *slog.Logger, tokenService *models.APITokenService) (*Settings, error) {
+	return &Settings{logger: logger, tokenService: tokenService}, nil
+}
+
+type settingsPageData struct {
+	Preferences      units.Preferences
+	TemperatureUnits []units.TemperatureUnit
+	SpeedUnits       []units.SpeedUnit
+	PressureUnits    []units.PressureUnit
+	Saved            bool
+	// Tokens are the signed in user's API tokens
+	Tokens []APITokenData
+	Scopes []string
+	// NewToken is shown once, right after it's created
+	NewToken  string
+	OIDCLabel string
+}
+
+type APITokenData struct {
+	ID       int
+	Name     string
+	Scope    string
+	Created  string
+	LastUsed string
+}
+
+func (settings *Settings) Settings(w http.ResponseWriter, r *http.Request) {
+	data, err := settings.pageData(r)
+	if err != nil {
+		settings.Templates.Settings.Execute(w, r, data, fmt.Errorf("server issue try again later"))
+		return
+	}
+	settings.Templates.Settings.Execute(w, r, data)
+}
+
+func (settings *Settings) pageData(r *http.Request) (*settingsPageData, error) {
+	data := &settingsPageData{
+		Preferences:      preferencesFromRequest(r),
+		TemperatureUnits: units.TemperatureUnits,
+		SpeedUnits:       units.SpeedUnits,
+		PressureUnits:    units.PressureUnits,
+		Saved:            r.URL.Query().Get("saved") != "",
+		Scopes:           models.Scopes,
+		OIDCLabel:        settings.OIDCLabel,
+	}
+	user := context.User(r.Context())
+	if user == nil {
+		return data, nil
+	}
+	tokens, err := settings.tokenService.List(r.Context(), user.ID)
+	if err != nil {
+		return data, err
+	}
+	for _, token := range tokens {
+		lastUsed := "never"
+		if !token.LastUsedAt.IsZero() {
+			lastUsed = token.LastUsedAt.Format(time.DateTime)
+		}
+		data.Tokens = append(data.Tokens, APITokenData{ID: token.ID, Name: token.Name, Scope: token.Scope,
+			Created: token.CreatedAt.Format(time.DateTime), LastUsed: lastUsed})
+	}
+	return data, nil
+}
+
+// CreateAPIToken makes a token for the signed in user and shows it once.
+func (settings *Settings) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		settings.logger.Error("Failed to parse form", slog.Any("error", err))
+		http.Error(w, "Server issue try again later", http.StatusBadRequest)
+		return
+	}
+	token, err := settings.tokenService.Create(r.Context(), currentUserID(r), r.FormValue("name"), r.FormValue("scope"))
+	data, dataErr := settings.pageData(r)
+	if err != nil {
+		settings.Templates.Settings.Execute(w, r, data, err)
+		return
+	}
+	if dataErr != nil {
+		settings.Templates.Settings.Execute(w, r, data, fmt.Errorf("server issue try again later"))
+		return
+	}
+	data.NewToken = token
+	settings.Templates.Settings.Execute(w, r, data)
+}
+
+func (settings *Settings) RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		settings.logger.Error("Failed to parse form", slog.Any("error", err))
+		http.Error(w, "Server issue try again later", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err == nil {
+		err = settings.tokenService.Revoke(r.Context(), currentUserID(r), id)
+	}
+	if err != nil {
+		data, _ := settings.pageData(r)
+		settings.Templates.Settings.Execute(w, r, data, fmt.Errorf("Failed to revoke API token"))
+		return
+	}
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
+
+func (settings *Settings) SavePreferences(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		settings.logger.Error("Failed to parse form", slog.Any("error", err))
+		http.Error(w, "Server issue try again later", http.StatusBadRequest)
+		return
+	}
+	prefs := units.ParsePreferences(r.PostForm)
+	http.SetCookie(w, &http.Cookie{
+		Name:     preferencesCookie,
+		Value:    prefs.Values().Encode(),
+		Path:     "/",
+		Expires:  time.Now().AddDate(1, 0, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/settings?saved=1", http.StatusFound)
+}
+
+// preferencesFromRequest reads the display preferences cookie, falling back
+// to the defaults when it's missing or garbled.
+func preferencesFromRequest(r *http.Request) units.Preferences {
+	cookie, err := r.Cookie(preferencesCookie)
+	if err != nil {
+		return units.DefaultPreferences()
+	}
+	values, err := url.ParseQuery(cookie.Value)
+	if err != nil {
+		return units.DefaultPreferences()
+	}
+	return units.ParsePreferences(values)
+}
@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/daniel-z-johnson/personal-weather/models"
+)
+
+// WundergroundUpload takes readings from stations set up to upload to
+// Weather Underground, pointed at this server instead. Stations only look at
+// the status and body, so errors are plain text.
+func (weather *Weather) WundergroundUpload(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	id := values.Get("ID")
+	for _, station := range weather.Stations {
+		if station.AuthenticateWunderground(id, values.Get("PASSWORD")) {
+			if err := weather.stationUpload(r.Context(), station, values); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintln(w, "success")
+			return
+		}
+	}
+	weather.logger.Warn("Station upload with unknown credentials", slog.String("station_id", id))
+	http.Error(w, "INVALID PASSWORDID|Password or key and/or id are incorrect", http.StatusUnauthorized)
+}
+
+// EcowittUpload takes readings from Ecowitt gateways set up with a
+// customized server using the Ecowitt protocol.
+func (weather *Weather) EcowittUpload(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		weather.logger.Error("Failed to parse form", slog.Any("error", err))
+		http.Error(w, "invalid upload", http.StatusBadRequest)
+		return
+	}
+	for _, station := range weather.Stations {
+		if station.AuthenticateEcowitt(r.PostForm.Get("PASSKEY")) {
+			if err := weather.stationUpload(r.Context(), station, r.PostForm); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+	weather.logger.Warn("Ecowitt upload with unknown passkey", slog.String("model", r.PostForm.Get("model")))
+	http.Error(w, "unknown passkey", http.StatusUnauthorized)
+}
+
+func (weather *Weather) stationUpload(ctx context.Context, station models.Station, values url.Values) error {
+	conditions, err := models.ParseStationUpload(values)
+	if err != nil {
+		weather.logger.Warn("Failed to read station upload", slog.String("station", station.Name), slog.Any("error", err))
+		return err
+	}
+	id, err := weather.weatherSerivce.GetStationLocationID(ctx, station.ID)
+	if err == nil && id == 0 {
+		// main saves every configured station at startup, the row is only missing
+		// when it was removed from the database since, so it is made again
+		id, err = weather.weatherSerivce.SaveStation(ctx, station)
+	}
+	if err != nil {
+		return fmt.Errorf("server issue try again later")
+	}
+	if err := weather.weatherSerivce.UpdateLocation(ctx, id, conditions); err != nil {
+		return fmt.Errorf("server issue try again later")
+	}
+	weather.locationRefreshed(ctx, id, nil)
+	return nil
+}
@@ -0,0 +1,284 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/daniel-z-johnson/personal-weather/context"
+	"github.com/daniel-z-johnson/personal-weather/models"
+)
+
+const sessionCookie = "session"
+
+type Users struct {
+	logger         *slog.Logger
+	userService    *models.UserService
+	sessionService *models.SessionService
+	tokenService   *models.APITokenService
+	// AllowSignup lets anyone create an account on the sign up page
+	AllowSignup bool
+	// OIDCLabel shows a button to sign in through OpenID Connect when set
+	OIDCLabel string
+	Templates struct {
+		SignIn Template
+		Setup  Template
+	}
+}
+
+func NewUsers(logger *slog.Logger, userService *models.UserService, sessionService *models.SessionService,
+	tokenService *models.APITokenService) (*Users, error) {
+	return &Users{logger: logger, userService: userService, sessionService: sessionService, tokenService: tokenService}, nil
+}
+
+type signInData struct {
+	Username string
+	// Next is where to go after signing in
+	Next string
+	// Signup shows the sign up form instead of first user setup, and a link
+	// to it on the sign in page
+	Signup bool
+	// OIDCLabel names the single sign-on provider, empty hides the button
+	OIDCLabel string
+}
+
+func (users *Users) signInPage(username, next string) *signInData {
+	return &signInData{Username: username, Next: next, Signup: users.AllowSignup, OIDCLabel: users.OIDCLabel}
+}
+
+func (users *Users) SignIn(w http.ResponseWriter, r *http.Request) {
+	count, err := users.userService.Count(r.Context())
+	if err != nil {
+		users.Templates.SignIn.Execute(w, r, &signInData{}, fmt.Errorf("server issue try again later"))
+		return
+	}
+	// with single sign-on the first user can come from the provider instead
+	if count == 0 && users.OIDCLabel == "" {
+		http.Redirect(w, r, "/setup", http.StatusFound)
+		return
+	}
+	users.Templates.SignIn.Execute(w, r, users.signInPage("", safeNext(r.URL.Query().Get("next"))))
+}
+
+func (users *Users) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		users.logger.Error("Failed to parse form", slog.Any("error", err))
+		users.Templates.SignIn.Execute(w, r, &signInData{}, fmt.Errorf("Server issue try again later"))
+		return
+	}
+	data := users.signInPage(r.FormValue("username"), safeNext(r.FormValue("next")))
+	user, err := users.userService.Authenticate(r.Context(), data.Username, r.FormValue("password"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCredentials) {
+			users.logger.Warn("Failed sign in", slog.String("username", data.Username))
+			users.Templates.SignIn.Execute(w, r, data, fmt.Errorf("Invalid username or password"))
+			return
+		}
+		users.Templates.SignIn.Execute(w, r, data, fmt.Errorf("Server issue try again later"))
+		return
+	}
+	users.startSession(w, r, user, data.Next)
+}
+
+func (users *Users) SignOut(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		users.sessionService.Delete(r.Context(), cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// Setup creates the first user, once there is one it only redirects to sign in.
+func (users *Users) Setup(w http.ResponseWriter, r *http.Request) {
+	if !users.needsSetup(w, r) {
+		return
+	}
+	users.Templates.Setup.Execute(w, r, &signInData{})
+}
+
+func (users *Users) ProcessSetup(w http.ResponseWriter, r *http.Request) {
+	if !users.needsSetup(w, r) {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		users.logger.Error("Failed to parse form", slog.Any("error", err))
+		users.Templates.Setup.Execute(w, r, &signInData{}, fmt.Errorf("Server issue try again later"))
+		return
+	}
+	users.createUser(w, r, &signInData{Username: r.FormValue("username")})
+}
+
+// Signup lets anyone create an account when AllowSignup is on.
+func (users *Users) Signup(w http.ResponseWriter, r *http.Request) {
+	if !users.AllowSignup {
+		http.NotFound(w, r)
+		return
+	}
+	users.Templates.Setup.Execute(w, r, &signInData{Signup: true})
+}
+
+func (users *Users) ProcessSignup(w http.ResponseWriter, r *http.Request) {
+	if !users.AllowSignup {
+		http.NotFound(w, r)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		users.logger.Error("Failed to parse form", slog.Any("error", err))
+		users.Templates.Setup.Execute(w, r, &signInData{Signup: true}, fmt.Errorf("Server issue try again later"))
+		return
+	}
+	users.createUser(w, r, &signInData{Username: r.FormValue("username"), Signup: true})
+}
+
+func (users *Users) createUser(w http.ResponseWriter, r *http.Request, data *signInData) {
+	if r.FormValue("password") != r.FormValue("confirm") {
+		users.Templates.Setup.Execute(w, r, data, fmt.Errorf("Passwords don't match"))
+		return
+	}
+	user, err := users.userService.Create(r.Context(), data.Username, r.FormValue("password"))
+	if err != nil {
+		users.Templates.Setup.Execute(w, r, data, err)
+		return
+	}
+	users.startSession(w, r, user, "/")
+}
+
+func (users *Users) needsSetup(w http.ResponseWriter, r *http.Request) bool {
+	count, err := users.userService.Count(r.Context())
+	if err != nil {
+		http.Error(w, "Server issue try again later", http.StatusInternalServerError)
+		return false
+	}
+	if count > 0 {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return false
+	}
+	return true
+}
+
+func (users *Users) startSession(w http.ResponseWriter, r *http.Request, user *models.User, next string) {
+	token, err := users.sessionService.Create(r.Context(), user.ID)
+	if err != nil {
+		users.Templates.SignIn.Execute(w, r, &signInData{Username: user.Username}, fmt.Errorf("Server issue try again later"))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(users.sessionService.TTL),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// keeps other sites from posting forms with the session
+		SameSite: http.SameSiteLaxMode,
+	})
+	users.logger.Info("User signed in", slog.String("username", user.Username))
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// SetUser puts the signed in user, if any, in the request context.
+func (users *Users) SetUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessionCookie)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, err := users.sessionService.User(r.Context(), cookie.Value)
+		if err != nil || user == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithUser(r.Context(), user)))
+	})
+}
+
+// RequireUser sends anyone not signed in to the sign in page, it has to run
+// after SetUser.
+func (users *Users) RequireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if context.User(r.Context()) == nil {
+			target := "/"
+			if r.Method == http.MethodGet {
+				target = r.URL.RequestURI()
+			}
+			http.Redirect(w, r, "/signin?next="+url.QueryEscape(target), http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireAdmin answers 403 to signed in users who aren't the admin, it has to
+// run after RequireUser.
+func (users *Users) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := context.User(r.Context()); user == nil || !user.IsAdmin() {
+			http.Error(w, "Only the admin can see this page", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// currentUserID is the signed in user, or the default user who owns every
+// location while authentication is off.
+func currentUserID(r *http.Request) int {
+	if user := context.User(r.Context()); user != nil {
+		return user.ID
+	}
+	return models.DefaultUserID
+}
+
+// RequireScope protects the JSON API. Scripts send an API token with the
+// scope as "Authorization: Bearer <token>", a signed in browser can do
+// anything its user can.
+func (users *Users) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if header == "" {
+				if context.User(r.Context()) == nil {
+					writeJSONError(w, http.StatusUnauthorized, "sign in or send an API token")
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			token, ok := strings.CutPrefix(header, "Bearer ")
+			if !ok {
+				writeJSONError(w, http.StatusUnauthorized, "authorization must be a bearer token")
+				return
+			}
+			user, apiToken, err := users.tokenService.Authenticate(r.Context(), token)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, "server issue try again later")
+				return
+			}
+			if user == nil {
+				writeJSONError(w, http.StatusUnauthorized, "invalid API token")
+				return
+			}
+			if !apiToken.Allows(scope) {
+				writeJSONError(w, http.StatusForbidden, fmt.Sprintf("API token needs the %s scope", scope))
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithUser(r.Context(), user)))
+		})
+	}
+}
+
+// safeNext only allows redirects to paths on this site.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daniel-z-johnson/personal-weather/context"
+	"github.com/daniel-z-johnson/personal-weather/models"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	handler := (&Users{}).RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, tc := range []struct {
+		name string
+		user *models.User
+		want int
+	}{
+		{"admin", &models.User{ID: models.DefaultUserID, Username: "dan"}, http.StatusNoContent},
+		{"other user", &models.User{ID: 2, Username: "guest"}, http.StatusForbidden},
+		{"signed out", nil, http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/admin/webhooks", nil)
+		if tc.user != nil {
+			r = r.WithContext(context.WithUser(r.Context(), tc.user))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	db := openTestDB(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	user, err := (&models.UserService{DB: db, Logger: logger}).Create(t.Context(), "dan", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenService := &models.APITokenService{DB: db, Logger: logger}
+	readToken, err := tokenService.Create(t.Context(), user.ID, "dashboard", models.ScopeRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manageToken, err := tokenService.Create(t.Context(), user.ID, "scripts", models.ScopeManage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := &Users{logger: logger, tokenService: tokenService}
+	for _, tc := range []struct {
+		name          string
+		scope         string
+		authorization string
+		signedIn      bool
+		want          int
+	}{
+		{"no token or session", models.ScopeRead, "", false, http.StatusUnauthorized},
+		{"signed in browser", models.ScopeManage, "", true, http.StatusNoContent},
+		{"read token reading", models.ScopeRead, "Bearer " + readToken, false, http.StatusNoContent},
+		{"read token managing", models.ScopeManage, "Bearer " + readToken, false, http.StatusForbidden},
+		{"manage token reading", models.ScopeRead, "Bearer " + manageToken, false, http.StatusNoContent},
+		{"unknown token", models.ScopeRead, "Bearer pw_unknown", false, http.StatusUnauthorized},
+		{"not a bearer token", models.ScopeRead, "Basic ZGFuOnB3", false, http.StatusUnauthorized},
+	} {
+		handler := users.RequireScope(tc.scope)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if context.User(r.Context()) == nil {
+				t.Errorf("%s: no user for the handler", tc.name)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/api/locations", nil)
+		if tc.authorization != "" {
+			r.Header.Set("Authorization", tc.authorization)
+		}
+		if tc.signedIn {
+			r = r.WithContext(context.WithUser(r.Context(), user))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
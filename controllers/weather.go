@@ -1,92 +1,387 @@
 package controllers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/daniel-z-johnson/personal-weather/models"
+	"github.com/daniel-z-johnson/personal-weather/units"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 type Weather struct {
 	logger         *slog.Logger
-	openWeatherAPI *models.OpenWeatherAPI
+	provider       *models.BudgetedProvider
+	geocoder       models.Geocoder
 	weatherSerivce *models.WeatherService
-	Templates      struct {
-		Main    Template
-		Cities  Template
-		Manage  Template
+	// Language is the code of the local city names to show, e.g. "de" or "ja",
+	// cities without a name in that language use their English name
+	Language string
+	// RefreshHooks are told about every location refreshed from the provider
+	RefreshHooks []models.RefreshHook
+	// DeleteHooks are told about every location a user deletes
+	DeleteHooks []models.DeleteHook
+	// Stations are the personal weather stations allowed to upload readings
+	Stations []models.Station
+	// refreshes coalesces concurrent refreshes of the same coordinates
+	refreshes singleflight.Group
+	writeMu   sync.Mutex
+	Templates struct {
+		Main   Template
+		Cities Template
+		Manage Template
+		Alerts Template
 	}
 }
 
 type LocationPageData struct {
 	City      string
+	Zip       string
 	State     string
 	Country   string
 	Latitude  float64
 	Longitude float64
+	// LocalNames is the JSON encoded map of language code to name, it rides
+	// along in a hidden form field until the location is saved
+	LocalNames string
 }
 
 type LocationTemp struct {
-	ID      int
-	City    string
-	State   string
-	Country string
-	TempF   string
-	TempC   string
+	ID          int
+	City        string
+	State       string
+	Country     string
+	Temperature string
+	FeelsLike   string
+	Humidity    string
+	Wind        string
+	Pressure    string
+	Updated     string
+	// Station is set for personal weather stations
+	Station bool
+	// Alerts are the events of the alerts in effect, e.g. "Winter Storm Warning"
+	Alerts []string
 }
 
-func NewWeather(logger *slog.Logger, openWeatherAPI *models.OpenWeatherAPI, openWeatherService *models.WeatherService) (*Weather, error) {
-	return &Weather{logger: logger, openWeatherAPI: openWeatherAPI, weatherSerivce: openWeatherService}, nil
+func newLocationTemp(v models.Location, prefs units.Preferences, language string) LocationTemp {
+	return LocationTemp{
+		ID:          v.ID,
+		City:        v.DisplayName(language),
+		State:       v.State,
+		Country:     v.Country,
+		Temperature: prefs.FormatTemperature(v.Temperature),
+		FeelsLike:   prefs.FormatTemperature(v.FeelsLike),
+		Humidity:    fmt.Sprintf("%.f%%", v.Humidity),
+		Wind:        prefs.FormatWind(v.WindSpeed, units.MetersPerSecond),
+		Pressure:    prefs.FormatPressure(v.Pressure, units.Hectopascals),
+		Updated:     prefs.FormatTime(v.ObservedAt),
+		Station:     v.Provider == models.ProviderStation,
+	}
+}
+
+// when less than a tenth of the day's API budget is left a page load only
+// refreshes this many locations, the stalest ones
+const lowBudgetRefreshes = 2
+
+// how many expired locations are refreshed at the same time
+const refreshWorkers = 4
+
+// how long a refresh holds its claim on the locations, well past the
+// provider's timeout, a crashed server's claims run out on their own
+const refreshClaim = time.Minute
+
+func NewWeather(logger *slog.Logger, provider *models.BudgetedProvider, geocoder models.Geocoder, openWeatherService *models.WeatherService) (*Weather, error) {
+	return &Weather{logger: logger, provider: provider, geocoder: geocoder, weatherSerivce: openWeatherService}, nil
 }
 
 func (weather *Weather) Main(w http.ResponseWriter, r *http.Request) {
 	type Data struct {
 		Locations []LocationTemp
 		Errors    []error
+		Usage     models.APIUsage
 	}
-	expired, err := weather.weatherSerivce.GetAllExpired()
+	userID := currentUserID(r)
+	expired, err := weather.weatherSerivce.GetAllExpired(r.Context(), userID)
 	if err != nil {
 		weather.logger.Error("Failed to get expired locations", slog.Any("error", err))
 		weather.Templates.Main.Execute(w, r, nil, fmt.Errorf("server issue try again later"))
 		return
 	}
-	for _, v := range expired {
-		temp, err := weather.openWeatherAPI.GetTemperature(v.Latitude, v.Longitude)
-		if err != nil {
-			weather.logger.Error("Failed to get temperature for expired location", slog.Any("error", err),
-				slog.String("city", v.Name), slog.String("state", v.State), slog.String("country", v.Country),
-				slog.Float64("latitude", v.Latitude), slog.Float64("longitude", v.Longitude))
-			continue // skip this location if we can't get the temperature
-		}
-		err = weather.weatherSerivce.UpdateLocation(v.ID, temp)
-		if err != nil {
-			weather.logger.Error("Failed to update expired location", slog.Any("error", err),
-				slog.String("city", v.Name), slog.String("state", v.State), slog.String("country", v.Country),
-				slog.Float64("latitude", v.Latitude), slog.Float64("longitude", v.Longitude))
-			continue // skip this location if we can't update it
-		}
-	}
-	allLocations, err := weather.weatherSerivce.GetAll()
+	refreshErrors := weather.refreshExpired(r.Context(), expired)
+	allLocations, err := weather.weatherSerivce.GetAll(r.Context(), userID)
 	if err != nil {
 		weather.logger.Error("Failed to get all locations after updating expired", slog.Any("error", err))
 		weather.Templates.Main.Execute(w, r, nil, fmt.Errorf("server issue try again later"))
 		return
 	}
+	alerts, err := weather.weatherSerivce.GetActiveAlerts(r.Context(), userID)
+	if err != nil {
+		weather.logger.Error("Failed to get active alerts", slog.Any("error", err))
+		weather.Templates.Main.Execute(w, r, nil, fmt.Errorf("server issue try again later"))
+		return
+	}
+	alertEvents := make(map[int][]string)
+	for _, alert := range alerts {
+		alertEvents[alert.LocationID] = append(alertEvents[alert.LocationID], alert.Event)
+	}
+	prefs := preferencesFromRequest(r)
 	locationTemps := make([]LocationTemp, 0)
 	for _, v := range allLocations {
-		var locationTemp LocationTemp
-		locationTemp.ID = v.ID
-		locationTemp.City = v.City
-		locationTemp.State = v.State
-		locationTemp.Country = v.Country
-		locationTemp.TempF = fmt.Sprintf("%.f", v.Temperature)
-		locationTemp.TempC = fmt.Sprintf("%.f", (v.Temperature-32)*5/9)
+		locationTemp := newLocationTemp(v, prefs, weather.Language)
+		locationTemp.Alerts = alertEvents[v.ID]
 		locationTemps = append(locationTemps, locationTemp)
 	}
 
-	weather.Templates.Main.Execute(w, r, &Data{Locations: locationTemps})
+	// the gauge shows the calls this page load made too
+	usage, err := weather.provider.Usage(r.Context())
+	if err != nil {
+		weather.logger.Error("Failed to get weather API usage", slog.String("error", err.Error()))
+		weather.Templates.Main.Execute(w, r, nil, fmt.Errorf("server issue try again later"))
+		return
+	}
+	weather.Templates.Main.Execute(w, r, &Data{Locations: locationTemps, Usage: usage}, refreshErrors...)
+}
+
+// refreshExpired gets new conditions for the expired locations, a few at a
+// time, and returns what went wrong for the page to show. Locations that
+// aren't refreshed keep their old conditions.
+func (weather *Weather) refreshExpired(ctx context.Context, expired []models.GeoLocation) []error {
+	// other users' locations at the same coordinates are refreshed with the
+	// first one
+	var stale []models.GeoLocation
+	seen := make(map[[2]float64]bool)
+	for _, v := range expired {
+		coordinates := [2]float64{v.Latitude, v.Longitude}
+		if !seen[coordinates] {
+			seen[coordinates] = true
+			stale = append(stale, v)
+		}
+	}
+	if len(stale) > lowBudgetRefreshes {
+		// a failed lookup leaves it to the budget to stop the calls
+		usage, err := weather.provider.Usage(ctx)
+		if err == nil && usage.Low() {
+			weather.logger.Info("Weather API budget is low, leaving locations stale",
+				slog.Int("remaining", usage.Remaining()), slog.Int("stale", len(stale)-lowBudgetRefreshes))
+			stale = stale[:lowBudgetRefreshes]
+		}
+	}
+	// each worker sets only its own entry
+	failures := make([]error, len(stale))
+	var g errgroup.Group
+	g.SetLimit(refreshWorkers)
+	for i, v := range stale {
+		g.Go(func() error {
+			failures[i] = weather.refreshCoalesced(ctx, v)
+			return nil
+		})
+	}
+	g.Wait()
+	var errs []error
+	shown := make(map[string]bool)
+	for i, err := range failures {
+		var message error
+		var providerErr *models.ProviderError
+		switch {
+		case err == nil:
+			continue
+		case ctx.Err() != nil:
+			// the visitor left or the server is stopping
+			continue
+		case errors.Is(err, models.ErrBudgetExhausted) || errors.Is(err, models.ErrRateLimited):
+			message = fmt.Errorf("Some locations weren't refreshed: %w", err)
+		case errors.As(err, &providerErr) && providerErr.Kind != nil:
+			message = providerMessage(err)
+		default:
+			errs = append(errs, fmt.Errorf("Couldn't refresh %s, showing older conditions", stale[i].Name))
+			continue
+		}
+		// the rest fail the same way, one message covers them
+		if !shown[message.Error()] {
+			shown[message.Error()] = true
+			errs = append(errs, message)
+		}
+	}
+	return errs
+}
+
+// providerMessage is what to tell the user about a failed provider call,
+// "Server issue try again later" when it isn't about the provider.
+func providerMessage(err error) error {
+	var providerErr *models.ProviderError
+	errors.As(err, &providerErr)
+	switch {
+	case errors.Is(err, models.ErrBudgetExhausted):
+		return fmt.Errorf("Today's weather API budget is used up, try again tomorrow")
+	case errors.Is(err, models.ErrRateLimited):
+		return fmt.Errorf("Too many weather API calls, try again in a minute")
+	case errors.Is(err, models.ErrOneCallNotSubscribed):
+		return fmt.Errorf("Your OpenWeatherMap API key isn't subscribed to One Call 3.0, subscribe to the \"One Call by Call\" plan to get conditions")
+	case errors.Is(err, models.ErrProviderUnauthorized):
+		if providerErr != nil && providerErr.Message != "" {
+			return fmt.Errorf("The weather API rejected the API key: %s", providerErr.Message)
+		}
+		return fmt.Errorf("The weather API rejected the API key")
+	case errors.Is(err, models.ErrProviderQuota):
+		return fmt.Errorf("The API key's quota with the weather API is used up, try again later")
+	case errors.Is(err, models.ErrProviderNotFound):
+		return fmt.Errorf("The weather API couldn't find that place")
+	case errors.Is(err, models.ErrProviderUnavailable):
+		return fmt.Errorf("The weather API is unavailable, try again later")
+	case errors.Is(err, models.ErrProviderDecode):
+		return fmt.Errorf("The weather API sent a response that couldn't be read, try again later")
+	}
+	return fmt.Errorf("Server issue try again later")
+}
+
+// refreshCoalesced refreshes the coordinates of v once however many requests
+// ask at the same time, they all wait for the same call, which runs with the
+// first request's context. The claim in the
+// database keeps other servers sharing it from refreshing them too.
+func (weather *Weather) refreshCoalesced(ctx context.Context, v models.GeoLocation) error {
+	key := strconv.FormatFloat(v.Latitude, 'f', -1, 64) + "," + strconv.FormatFloat(v.Longitude, 'f', -1, 64)
+	_, err, _ := weather.refreshes.Do(key, func() (any, error) {
+		claimed, err := weather.weatherSerivce.ClaimExpired(ctx, v.Latitude, v.Longitude, refreshClaim)
+		if err != nil || !claimed {
+			// unclaimed means it's fresh by now or someone else is on it
+			return nil, err
+		}
+		if err := weather.refreshLocation(ctx, v); err != nil {
+			// released even when the visitor left, so the next one can try
+			weather.weatherSerivce.ReleaseClaim(context.WithoutCancel(ctx), v.Latitude, v.Longitude)
+			return nil, err
+		}
+		return nil, nil
+	})
+	if errors.Is(err, context.Canceled) && ctx.Err() == nil {
+		// the request that made the call went away, this one is still waiting
+		return weather.refreshCoalesced(ctx, v)
+	}
+	return err
+}
+
+// refreshLocation fetches the conditions at v and saves them to every
+// location at its coordinates. Saving holds writeMu so workers don't write
+// to SQLite at the same time, the hooks run after it's released.
+func (weather *Weather) refreshLocation(ctx context.Context, v models.GeoLocation) error {
+	conditions, err := weather.provider.GetConditions(ctx, v.Latitude, v.Longitude)
+	if errors.Is(err, models.ErrBudgetExhausted) || errors.Is(err, models.ErrRateLimited) || errors.Is(err, models.ErrCircuitOpen) {
+		weather.logger.Warn("Not refreshing location", slog.Any("error", err), slog.String("city", v.Name))
+		return err
+	}
+	if err != nil {
+		weather.logger.Error("Failed to get conditions for expired location", slog.Any("error", err),
+			slog.String("city", v.Name), slog.String("state", v.State), slog.String("country", v.Country),
+			slog.Float64("latitude", v.Latitude), slog.Float64("longitude", v.Longitude))
+		return err
+	}
+	refreshed, err := weather.saveConditions(ctx, v, conditions)
+	if err != nil {
+		return err
+	}
+	for _, location := range refreshed {
+		weather.locationRefreshed(ctx, location.id, location.newAlerts)
+	}
+	return nil
+}
+
+// refreshedLocation is a location that got new conditions, with the alerts
+// that weren't seen before.
+type refreshedLocation struct {
+	id        int
+	newAlerts []models.Alert
+}
+
+func (weather *Weather) saveConditions(ctx context.Context, v models.GeoLocation, conditions *models.Conditions) ([]refreshedLocation, error) {
+	weather.writeMu.Lock()
+	defer weather.writeMu.Unlock()
+	ids, err := weather.weatherSerivce.UpdateLocationsAt(ctx, v.Latitude, v.Longitude, conditions)
+	if err != nil {
+		weather.logger.Error("Failed to update expired location", slog.Any("error", err),
+			slog.String("city", v.Name), slog.String("state", v.State), slog.String("country", v.Country),
+			slog.Float64("latitude", v.Latitude), slog.Float64("longitude", v.Longitude))
+		return nil, err
+	}
+	refreshed := make([]refreshedLocation, 0, len(ids))
+	for _, id := range ids {
+		newAlerts, err := weather.weatherSerivce.SaveAlerts(ctx, id, conditions.Alerts)
+		if err != nil {
+			weather.logger.Error("Failed to save alerts for expired location", slog.Any("error", err),
+				slog.Int("id", id), slog.String("city", v.Name), slog.String("state", v.State), slog.String("country", v.Country))
+			continue
+		}
+		refreshed = append(refreshed, refreshedLocation{id: id, newAlerts: newAlerts})
+	}
+	return refreshed, nil
+}
+
+func (weather *Weather) locationRefreshed(ctx context.Context, id int, newAlerts []models.Alert) {
+	if len(weather.RefreshHooks) == 0 {
+		return
+	}
+	location, err := weather.weatherSerivce.GetLocationByID(ctx, id)
+	if err != nil || location == nil {
+		weather.logger.Error("Failed to load refreshed location", slog.Any("error", err), slog.Int("id", id))
+		return
+	}
+	// hooks send in the background, they shouldn't stop when the page is done
+	hookCtx := context.WithoutCancel(ctx)
+	for _, hook := range weather.RefreshHooks {
+		hook.LocationRefreshed(hookCtx, location, newAlerts)
+	}
+}
+
+func (weather *Weather) locationDeleted(ctx context.Context, id int) {
+	hookCtx := context.WithoutCancel(ctx)
+	for _, hook := range weather.DeleteHooks {
+		hook.LocationDeleted(hookCtx, id)
+	}
+}
+
+func (weather *Weather) Alerts(w http.ResponseWriter, r *http.Request) {
+	type AlertData struct {
+		City        string
+		State       string
+		Country     string
+		Sender      string
+		Event       string
+		Start       string
+		End         string
+		Description string
+	}
+	type Data struct {
+		Alerts []AlertData
+	}
+	alerts, err := weather.weatherSerivce.GetActiveAlerts(r.Context(), currentUserID(r))
+	if err != nil {
+		weather.logger.Error("Failed to get active alerts", slog.Any("error", err))
+		weather.Templates.Alerts.Execute(w, r, nil, fmt.Errorf("server issue try again later"))
+		return
+	}
+	prefs := preferencesFromRequest(r)
+	var data Data
+	for _, alert := range alerts {
+		data.Alerts = append(data.Alerts, AlertData{
+			City:        alert.City,
+			State:       alert.State,
+			Country:     alert.Country,
+			Sender:      alert.Sender,
+			Event:       alert.Event,
+			Start:       alert.Start.Format("Mon Jan 2") + " " + prefs.FormatTime(alert.Start),
+			End:         alert.End.Format("Mon Jan 2") + " " + prefs.FormatTime(alert.End),
+			Description: alert.Description,
+		})
+	}
+	weather.Templates.Alerts.Execute(w, r, &data)
 }
 
 func (weather *Weather) Cities(w http.ResponseWriter, r *http.Request) {
@@ -121,7 +416,20 @@ func (weather *Weather) AddCity(w http.ResponseWriter, r *http.Request) {
 	}
 	data.Form.Longitude = long
 	data.Form.Latitude = lat
-	err = weather.weatherSerivce.SaveLocation(data.Form.City, data.Form.State, data.Form.Country, data.Form.Latitude, data.Form.Longitude)
+	localNames := make(map[string]string)
+	if value := r.FormValue("local_names"); value != "" {
+		if err := json.Unmarshal([]byte(value), &localNames); err != nil {
+			// local names are nice to have, save the location without them
+			weather.logger.Warn("Failed to parse local names", slog.Any("error", err))
+			localNames = make(map[string]string)
+		}
+	}
+	_, err = weather.weatherSerivce.SaveLocation(r.Context(), currentUserID(r), data.Form.City, data.Form.State, data.Form.Country, data.Form.Latitude, data.Form.Longitude, localNames)
+	if err != nil {
+		weather.logger.Error("Failed to save location", slog.Any("error", err))
+		weather.Templates.Cities.Execute(w, r, nil, fmt.Errorf("Server issue try again later"))
+		return
+	}
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
@@ -140,20 +448,115 @@ func (weather *Weather) FindCities(w http.ResponseWriter, r *http.Request) {
 	data.Form.City = r.FormValue("city")
 	data.Form.State = r.FormValue("state")
 	data.Form.Country = r.FormValue("country")
-	locations, err := weather.openWeatherAPI.GetCityCoordinates(data.Form.City, data.Form.State, data.Form.Country)
+	locations, err := weather.geocoder.GetCityCoordinates(r.Context(), data.Form.City, data.Form.State, data.Form.Country)
+	if err != nil {
+		weather.logger.Error("Failed to find cities", slog.Any("error", err))
+		weather.Templates.Cities.Execute(w, r, &data, providerMessage(err))
+		return
+	}
+	data.Locations = make([]LocationPageData, 0)
+	for _, loc := range locations {
+		data.Locations = append(data.Locations, LocationPageData{
+			City:       loc.Name,
+			State:      loc.State,
+			Country:    loc.Country,
+			Latitude:   loc.Latitude,
+			Longitude:  loc.Longitude,
+			LocalNames: encodeLocalNames(loc.LocalNames),
+		})
+	}
+	weather.Templates.Cities.Execute(w, r, &data)
+}
+
+func (weather *Weather) FindCitiesByZip(w http.ResponseWriter, r *http.Request) {
+	type Data struct {
+		Form      LocationPageData
+		Locations []LocationPageData
+	}
+	err := r.ParseForm()
 	if err != nil {
 		weather.logger.Error("Failed to parse form", slog.Any("error", err))
 		weather.Templates.Cities.Execute(w, r, nil, fmt.Errorf("Server issue try again later"))
 		return
 	}
+	var data Data
+	data.Form.Zip = r.FormValue("zip")
+	data.Form.Country = r.FormValue("country")
+	locations, err := weather.geocoder.GetZipCoordinates(r.Context(), data.Form.Zip, data.Form.Country)
+	if err != nil {
+		weather.logger.Error("Failed to look up postal code", slog.Any("error", err), slog.String("zip", data.Form.Zip))
+		weather.Templates.Cities.Execute(w, r, &data, providerMessage(err))
+		return
+	}
 	data.Locations = make([]LocationPageData, 0)
 	for _, loc := range locations {
 		data.Locations = append(data.Locations, LocationPageData{
-			City:      loc.Name,
-			State:     loc.State,
-			Country:   loc.Country,
-			Latitude:  loc.Latitude,
-			Longitude: loc.Longitude,
+			City:       loc.Name,
+			State:      loc.State,
+			Country:    loc.Country,
+			Latitude:   loc.Latitude,
+			Longitude:  loc.Longitude,
+			LocalNames: encodeLocalNames(loc.LocalNames),
+		})
+	}
+	if len(data.Locations) == 0 {
+		weather.Templates.Cities.Execute(w, r, &data, fmt.Errorf("No places found for postal code %q", data.Form.Zip))
+		return
+	}
+	weather.Templates.Cities.Execute(w, r, &data)
+}
+
+func (weather *Weather) FindCitiesByCoordinates(w http.ResponseWriter, r *http.Request) {
+	type Data struct {
+		Form      LocationPageData
+		Locations []LocationPageData
+	}
+	err := r.ParseForm()
+	if err != nil {
+		weather.logger.Error("Failed to parse form", slog.Any("error", err))
+		weather.Templates.Cities.Execute(w, r, nil, fmt.Errorf("Server issue try again later"))
+		return
+	}
+	var data Data
+	lat, err := strconv.ParseFloat(strings.TrimSpace(r.FormValue("latitude")), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		weather.logger.Error("Failed to parse latitude", slog.Any("error", err), slog.String("latitude", r.FormValue("latitude")))
+		weather.Templates.Cities.Execute(w, r, nil, fmt.Errorf("Invalid latitude value, must be between -90 and 90"))
+		return
+	}
+	long, err := strconv.ParseFloat(strings.TrimSpace(r.FormValue("longitude")), 64)
+	if err != nil || long < -180 || long > 180 {
+		weather.logger.Error("Failed to parse longitude", slog.Any("error", err), slog.String("longitude", r.FormValue("longitude")))
+		weather.Templates.Cities.Execute(w, r, nil, fmt.Errorf("Invalid longitude value, must be between -180 and 180"))
+		return
+	}
+	data.Form.Latitude = lat
+	data.Form.Longitude = long
+	locations, err := weather.geocoder.ReverseGeocode(r.Context(), lat, long)
+	if err != nil {
+		weather.logger.Error("Failed to reverse geocode coordinates", slog.Any("error", err),
+			slog.Float64("latitude", lat), slog.Float64("longitude", long))
+		weather.Templates.Cities.Execute(w, r, &data, providerMessage(err))
+		return
+	}
+	// the names come from the provider but the coordinates are the ones the user asked for
+	data.Locations = make([]LocationPageData, 0)
+	for _, loc := range locations {
+		data.Locations = append(data.Locations, LocationPageData{
+			City:       loc.Name,
+			State:      loc.State,
+			Country:    loc.Country,
+			Latitude:   lat,
+			Longitude:  long,
+			LocalNames: encodeLocalNames(loc.LocalNames),
+		})
+	}
+	if len(data.Locations) == 0 {
+		// nothing nearby has a name (e.g. open ocean), still allow saving the spot
+		data.Locations = append(data.Locations, LocationPageData{
+			City:      fmt.Sprintf("%.4f, %.4f", lat, long),
+			Latitude:  lat,
+			Longitude: long,
 		})
 	}
 	weather.Templates.Cities.Execute(w, r, &data)
@@ -163,22 +566,16 @@ func (weather *Weather) Manage(w http.ResponseWriter, r *http.Request) {
 	type Data struct {
 		Locations []LocationTemp
 	}
-	allLocations, err := weather.weatherSerivce.GetAll()
+	allLocations, err := weather.weatherSerivce.GetAll(r.Context(), currentUserID(r))
 	if err != nil {
 		weather.logger.Error("Failed to get all locations for manage page", slog.Any("error", err))
 		weather.Templates.Manage.Execute(w, r, nil, fmt.Errorf("server issue try again later"))
 		return
 	}
+	prefs := preferencesFromRequest(r)
 	locationTemps := make([]LocationTemp, 0)
 	for _, v := range allLocations {
-		var locationTemp LocationTemp
-		locationTemp.ID = v.ID
-		locationTemp.City = v.City
-		locationTemp.State = v.State
-		locationTemp.Country = v.Country
-		locationTemp.TempF = fmt.Sprintf("%.f", v.Temperature)
-		locationTemp.TempC = fmt.Sprintf("%.f", (v.Temperature-32)*5/9)
-		locationTemps = append(locationTemps, locationTemp)
+		locationTemps = append(locationTemps, newLocationTemp(v, prefs, weather.Language))
 	}
 
 	weather.Templates.Manage.Execute(w, r, &Data{Locations: locationTemps})
@@ -191,7 +588,7 @@ func (weather *Weather) DeleteLocation(w http.ResponseWriter, r *http.Request) {
 		weather.Templates.Manage.Execute(w, r, nil, fmt.Errorf("Server issue try again later"))
 		return
 	}
-	
+
 	idStr := r.FormValue("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
@@ -199,14 +596,32 @@ func (weather *Weather) DeleteLocation(w http.ResponseWriter, r *http.Request) {
 		weather.Templates.Manage.Execute(w, r, nil, fmt.Errorf("Invalid location ID"))
 		return
 	}
-	
-	err = weather.weatherSerivce.DeleteLocation(id)
+
+	err = weather.weatherSerivce.DeleteLocation(r.Context(), currentUserID(r), id)
 	if err != nil {
 		weather.logger.Error("Failed to delete location", slog.Any("error", err), slog.Int("id", id))
 		weather.Templates.Manage.Execute(w, r, nil, fmt.Errorf("Failed to delete location"))
 		return
 	}
-	
+	weather.locationDeleted(r.Context(), id)
+
 	// Redirect back to manage page after successful deletion
 	http.Redirect(w, r, "/manage", http.StatusFound)
 }
+
+func encodeLocalNames(localNames map[string]*string) string {
+	names := make(map[string]string)
+	for lang, name := range localNames {
+		if name != nil && *name != "" {
+			names[lang] = *name
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	encoded, err := json.Marshal(names)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
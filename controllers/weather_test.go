@@ -0,0 +1,258 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daniel-z-johnson/personal-weather/models"
+	"github.com/daniel-z-johnson/personal-weather/units"
+)
+
+type fixedProvider struct{}
+
+func (fixedProvider) GetConditions(context.Context, float64, float64) (*models.Conditions, error) {
+	return &models.Conditions{Temperature: units.FromCelsius(-3), Observed: time.Now()}, nil
+}
+
+// lockCheckingHook records whether the hooks run while the refresh still
+// holds writeMu.
+type lockCheckingHook struct {
+	weather *Weather
+	calls   int
+	locked  bool
+}
+
+func (h *lockCheckingHook) LocationRefreshed(context.Context, *models.Location, []models.Alert) {
+	h.calls++
+	if h.weather.writeMu.TryLock() {
+		h.weather.writeMu.Unlock()
+		return
+	}
+	h.locked = true
+}
+
+// testWeather is a Weather getting conditions from provider, with the places
+// saved by users 1 and 2.
+func testWeather(t *testing.T, provider models.ConditionsProvider, places ...models.GeoLocation) *Weather {
+	t.Helper()
+	db := openTestDB(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	weatherService := &models.WeatherService{DB: db, Logger: logger}
+	for _, place := range places {
+		for userID := 1; userID <= 2; userID++ {
+			_, err := weatherService.SaveLocation(t.Context(), userID, place.Name, place.State, place.Country, place.Latitude, place.Longitude, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	budgeted := &models.BudgetedProvider{Provider: provider, DB: db, Logger: logger, Name: "test"}
+	weather, err := NewWeather(logger, budgeted, nil, weatherService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return weather
+}
+
+var duluth = models.GeoLocation{Name: "Duluth", State: "MN", Country: "US", Latitude: 46.78, Longitude: -92.1}
+
+func TestRefreshHooksRunWithoutWriteLock(t *testing.T) {
+	weather := testWeather(t, fixedProvider{}, duluth)
+	hook := &lockCheckingHook{weather: weather}
+	weather.RefreshHooks = append(weather.RefreshHooks, hook)
+
+	if err := weather.refreshLocation(t.Context(), duluth); err != nil {
+		t.Fatal(err)
+	}
+	if hook.calls != 2 {
+		t.Errorf("hook called %d times, want once for each user's location", hook.calls)
+	}
+	if hook.locked {
+		t.Error("hooks ran while writeMu was held")
+	}
+}
+
+// countingProvider counts its calls and holds each one until release is
+// closed.
+type countingProvider struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (p *countingProvider) GetConditions(ctx context.Context, latitude, longitude float64) (*models.Conditions, error) {
+	p.calls.Add(1)
+	select {
+	case <-p.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return fixedProvider{}.GetConditions(ctx, latitude, longitude)
+}
+
+func TestRefreshCoalesced(t *testing.T) {
+	provider := &countingProvider{release: make(chan struct{})}
+	weather := testWeather(t, provider, duluth)
+	const requests = 10
+	var wg sync.WaitGroup
+	errs := make([]error, requests)
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = weather.refreshCoalesced(t.Context(), duluth)
+		}()
+	}
+	// give the others time to join the first call before it returns
+	for provider.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(provider.release)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := provider.calls.Load(); calls != 1 {
+		t.Errorf("%d provider calls for %d requests, want 1", calls, requests)
+	}
+	expired, err := weather.weatherSerivce.GetAllExpired(t.Context(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 0 {
+		t.Errorf("%d locations still expired", len(expired))
+	}
+}
+
+// pausingProvider fails at failLatitude and holds the other calls until
+// release is closed, keeping track of how many run at once.
+type pausingProvider struct {
+	failLatitude float64
+	release      chan struct{}
+
+	mu       sync.Mutex
+	calls    int
+	running  int
+	maxFound int
+}
+
+func (p *pausingProvider) GetConditions(ctx context.Context, latitude, longitude float64) (*models.Conditions, error) {
+	p.mu.Lock()
+	p.calls++
+	p.running++
+	p.maxFound = max(p.maxFound, p.running)
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.running--
+		p.mu.Unlock()
+	}()
+	if latitude == p.failLatitude {
+		return nil, errors.New("connection reset by peer")
+	}
+	select {
+	case <-p.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return fixedProvider{}.GetConditions(ctx, latitude, longitude)
+}
+
+func (p *pausingProvider) counts() (calls, running, maxFound int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls, p.running, p.maxFound
+}
+
+// towns are places different enough that each is refreshed on its own, the
+// first is where pausingProvider fails.
+func towns(n int) []models.GeoLocation {
+	places := make([]models.GeoLocation, 0, n)
+	for i := range n {
+		places = append(places, models.GeoLocation{Name: fmt.Sprintf("Town %d", i), Country: "US", Latitude: 40 + float64(i), Longitude: -90})
+	}
+	return places
+}
+
+func TestRefreshExpired(t *testing.T) {
+	places := towns(refreshWorkers * 2)
+	provider := &pausingProvider{failLatitude: places[0].Latitude, release: make(chan struct{})}
+	weather := testWeather(t, provider, places...)
+	expired, err := weather.weatherSerivce.GetAllExpired(t.Context(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan []error)
+	go func() { done <- weather.refreshExpired(t.Context(), expired) }()
+	// the failed call frees its worker, the pool fills up with held calls
+	for {
+		if _, running, _ := provider.counts(); running == refreshWorkers {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(provider.release)
+	errs := <-done
+
+	calls, _, maxFound := provider.counts()
+	if calls != len(places) {
+		t.Errorf("%d provider calls, want one for each of the %d places", calls, len(places))
+	}
+	if maxFound > refreshWorkers {
+		t.Errorf("%d calls ran at once, want at most %d", maxFound, refreshWorkers)
+	}
+	if fmt.Sprint(errs) != "[Couldn't refresh Town 0, showing older conditions]" {
+		t.Errorf("errors = %v", errs)
+	}
+}
+
+func TestRefreshExpiredCanceled(t *testing.T) {
+	places := towns(refreshWorkers * 2)
+	// none of them fail
+	provider := &pausingProvider{failLatitude: -1, release: make(chan struct{})}
+	weather := testWeather(t, provider, places...)
+	expired, err := weather.weatherSerivce.GetAllExpired(t.Context(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan []error)
+	go func() { done <- weather.refreshExpired(ctx, expired) }()
+	for {
+		if _, running, _ := provider.counts(); running == refreshWorkers {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// the visitor leaves
+	cancel()
+	select {
+	case errs := <-done:
+		if len(errs) != 0 {
+			t.Errorf("errors shown to a visitor who left: %v", errs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("refreshExpired kept going after the context was canceled")
+	}
+	if calls, _, _ := provider.counts(); calls != refreshWorkers {
+		t.Errorf("%d provider calls, want only the %d already running", calls, refreshWorkers)
+	}
+	// the places that weren't refreshed can be tried again
+	expired, err = weather.weatherSerivce.GetAllExpired(t.Context(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != len(places) {
+		t.Errorf("%d places can be refreshed again, want all %d", len(expired), len(places))
+	}
+}
@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/daniel-z-johnson/personal-weather/models"
+)
+
+type Webhooks struct {
+	logger     *slog.Logger
+	dispatcher *models.WebhookDispatcher
+	Templates  struct {
+		Webhooks Template
+	}
+}
+
+func NewWebhooks(logger *slog.Logger, dispatcher *models.WebhookDispatcher) (*Webhooks, error) {
+	return &Webhooks{logger: logger, dispatcher: dispatcher}, nil
+}
+
+type WebhookData struct {
+	Name   string
+	URL    string
+	Signed bool
+}
+
+type DeliveryData struct {
+	ID         int
+	Webhook    string
+	LocationID int
+	Status     string
+	Attempts   int
+	Response   string
+	Error      string
+	Created    string
+	Updated    string
+}
+
+// Webhooks is the admin page listing the webhooks and their latest deliveries.
+func (webhooks *Webhooks) Webhooks(w http.ResponseWriter, r *http.Request) {
+	type Data struct {
+		Webhooks   []WebhookData
+		Deliveries []DeliveryData
+	}
+	data := &Data{}
+	for _, webhook := range webhooks.dispatcher.Webhooks {
+		data.Webhooks = append(data.Webhooks, WebhookData{Name: webhook.Name, URL: webhook.URL, Signed: webhook.Secret != ""})
+	}
+	deliveries, err := webhooks.dispatcher.Deliveries(r.Context(), 100)
+	if err != nil {
+		webhooks.Templates.Webhooks.Execute(w, r, data, fmt.Errorf("server issue try again later"))
+		return
+	}
+	for _, delivery := range deliveries {
+		response := ""
+		if delivery.ResponseCode != 0 {
+			response = fmt.Sprintf("%d %s", delivery.ResponseCode, http.StatusText(delivery.ResponseCode))
+		}
+		data.Deliveries = append(data.Deliveries, DeliveryData{
+			ID:         delivery.ID,
+			Webhook:    delivery.Webhook,
+			LocationID: delivery.LocationID,
+			Status:     delivery.Status,
+			Attempts:   delivery.Attempts,
+			Response:   response,
+			Error:      delivery.Error,
+			Created:    delivery.CreatedAt.Format(time.DateTime),
+			Updated:    delivery.UpdatedAt.Format(time.DateTime),
+		})
+	}
+	webhooks.Templates.Webhooks.Execute(w, r, data)
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log/slog"
-	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/daniel-z-johnson/personal-weather/config"
 	"github.com/daniel-z-johnson/personal-weather/controllers"
 	"github.com/daniel-z-johnson/personal-weather/models"
+	"github.com/daniel-z-johnson/personal-weather/static"
 	"github.com/daniel-z-johnson/personal-weather/templates"
 	"github.com/daniel-z-johnson/personal-weather/views"
 	"github.com/go-chi/chi/v5"
@@ -19,6 +22,9 @@ import (
 
 func main() {
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	// a long GeoNames import is cut short too when the app is stopped
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	db, err := sql.Open("sqlite3", "w.db")
 	if err != nil {
 		logger.Error("Failed to open database", slog.Any("error", err))
@@ -37,32 +43,223 @@ func main() {
 		panic(err)
 	}
 	logger.Info("Configuration loaded", "config", conf.String())
-	weatherAPI := &models.OpenWeatherAPI{Logger: logger, APIKey: conf.WeatherAPI.Key}
+	httpConf := conf.WeatherAPI.HTTP
+	weatherAPI := &models.OpenWeatherAPI{Logger: logger, APIKey: conf.WeatherAPI.Key, Client: &models.ProviderClient{
+		Name:            models.ProviderOpenWeatherMap,
+		Logger:          logger,
+		Timeout:         httpConf.Timeout.Duration,
+		Retries:         httpConf.Retries,
+		Backoff:         httpConf.Backoff.Duration,
+		MaxBackoff:      httpConf.MaxBackoff.Duration,
+		BreakerFailures: httpConf.BreakerFailures,
+		BreakerCooldown: httpConf.BreakerCooldown.Duration,
+	}}
+	provider := &models.BudgetedProvider{Provider: weatherAPI, DB: db, Logger: logger, Name: models.ProviderOpenWeatherMap,
+		DailyLimit: conf.WeatherAPI.DailyLimit, PerMinute: conf.WeatherAPI.PerMinute}
+	// searches answered by the cache don't cost a call
+	var geocoder models.Geocoder = &models.BudgetedGeocoder{Geocoder: weatherAPI, Budget: provider}
+	geocoderName := models.ProviderOpenWeatherMap
+	if conf.Geocoding.GeoNamesFile != "" {
+		geoNames := &models.GeoNamesGeocoder{DB: db, Logger: logger}
+		if err := geoNames.Import(ctx, conf.Geocoding.GeoNamesFile); err != nil {
+			logger.Error("Failed to import GeoNames file", slog.Any("error", err))
+			panic(fmt.Errorf("Failed to import GeoNames file: %w", err))
+		}
+		if conf.Geocoding.GeoNamesPostalFile != "" {
+			if err := geoNames.ImportPostalCodes(ctx, conf.Geocoding.GeoNamesPostalFile); err != nil {
+				logger.Error("Failed to import GeoNames postal code file", slog.Any("error", err))
+				panic(fmt.Errorf("Failed to import GeoNames postal code file: %w", err))
+			}
+		}
+		if conf.Geocoding.GeoNamesAdmin1File != "" {
+			if err := geoNames.ImportAdmin1Codes(ctx, conf.Geocoding.GeoNamesAdmin1File); err != nil {
+				logger.Error("Failed to import GeoNames admin1 codes file", slog.Any("error", err))
+				panic(fmt.Errorf("Failed to import GeoNames admin1 codes file: %w", err))
+			}
+		}
+		geocoder = geoNames
+		geocoderName = models.GeocoderGeoNames
+	}
+	geocoder = &models.CachedGeocoder{Geocoder: geocoder, Name: geocoderName, DB: db, Logger: logger, TTL: conf.Geocoding.CacheTTL.Duration}
 	weatherService := &models.WeatherService{DB: db, Logger: logger}
-	weatherController, err := controllers.NewWeather(logger, weatherAPI, weatherService)
+	weatherController, err := controllers.NewWeather(logger, provider, geocoder, weatherService)
 	if err != nil {
 		// just fail at startup if something goes wrong at this point
 		panic(err)
 	}
+	weatherController.Language = conf.Display.Language
+	for _, stationConf := range conf.Stations {
+		station := models.Station{ID: stationConf.ID, Password: stationConf.Password, Passkey: stationConf.Passkey,
+			Name: stationConf.Name, State: stationConf.State, Country: stationConf.Country,
+			Latitude: stationConf.Latitude, Longitude: stationConf.Longitude}
+		if station.ID == "" || station.Name == "" || (station.Password == "" && station.Passkey == "") {
+			panic(fmt.Errorf("stations need an id, a name and a password or passkey, got %q", station.ID))
+		}
+		// the station shows up on the main page before its first upload
+		if _, err := weatherService.SaveStation(ctx, station); err != nil {
+			panic(fmt.Errorf("Failed to save station %s: %w", station.Name, err))
+		}
+		weatherController.Stations = append(weatherController.Stations, station)
+	}
+	notifier, err := newNotifier(conf, db, logger)
+	if err != nil {
+		// a typo in a rule should be found now, not when it's freezing at the cabin
+		panic(err)
+	}
+	weatherController.RefreshHooks = append(weatherController.RefreshHooks, notifier)
+	webhookDispatcher := &models.WebhookDispatcher{DB: db, Logger: logger, Shutdown: ctx}
+	for _, webhook := range conf.Webhooks {
+		if webhook.Name == "" || webhook.URL == "" {
+			panic(fmt.Errorf("webhooks need a name and a url, got %q", webhook.Name))
+		}
+		webhookDispatcher.Webhooks = append(webhookDispatcher.Webhooks, models.Webhook{Name: webhook.Name, URL: webhook.URL,
+			Secret: webhook.Secret, MaxAttempts: webhook.MaxAttempts})
+	}
+	weatherController.RefreshHooks = append(weatherController.RefreshHooks, webhookDispatcher)
+	if conf.MQTT.Broker != "" {
+		mqttPublisher, err := models.NewMQTTPublisher(models.MQTTOptions{
+			Broker:          conf.MQTT.Broker,
+			Username:        conf.MQTT.Username,
+			Password:        conf.MQTT.Password,
+			ClientID:        conf.MQTT.ClientID,
+			TopicPrefix:     conf.MQTT.TopicPrefix,
+			DiscoveryPrefix: conf.MQTT.DiscoveryPrefix,
+		}, weatherService, logger)
+		if err != nil {
+			logger.Error("Failed to set up MQTT", slog.Any("error", err))
+			panic(fmt.Errorf("Failed to set up MQTT: %w", err))
+		}
+		weatherController.RefreshHooks = append(weatherController.RefreshHooks, mqttPublisher)
+		weatherController.DeleteHooks = append(weatherController.DeleteHooks, mqttPublisher)
+	}
 	weatherController.Templates.Main =
 		views.Must(views.ParseFS(templates.FS, logger, "main-layout.gohtml", "main-page.gohtml"))
 	weatherController.Templates.Cities =
 		views.Must(views.ParseFS(templates.FS, logger, "main-layout.gohtml", "add-city.gohtml"))
 	weatherController.Templates.Manage =
 		views.Must(views.ParseFS(templates.FS, logger, "main-layout.gohtml", "manage-locations.gohtml"))
+	weatherController.Templates.Alerts =
+		views.Must(views.ParseFS(templates.FS, logger, "main-layout.gohtml", "alerts.gohtml"))
+
+	tokenService := &models.APITokenService{DB: db, Logger: logger}
+	settingsController, err := controllers.NewSettings(logger, tokenService)
+	if err != nil {
+		panic(err)
+	}
+	settingsController.Templates.Settings =
+		views.Must(views.ParseFS(templates.FS, logger, "main-layout.gohtml", "settings.gohtml"))
+
+	notificationsController, err := controllers.NewNotifications(logger, notifier)
+	if err != nil {
+		panic(err)
+	}
+	notificationsController.Templates.Notifications =
+		views.Must(views.ParseFS(templates.FS, logger, "main-layout.gohtml", "notifications.gohtml"))
+
+	webhooksController, err := controllers.NewWebhooks(logger, webhookDispatcher)
+	if err != nil {
+		panic(err)
+	}
+	webhooksController.Templates.Webhooks =
+		views.Must(views.ParseFS(templates.FS, logger, "main-layout.gohtml", "webhooks.gohtml"))
+
+	userService := &models.UserService{DB: db, Logger: logger}
+	sessionService := &models.SessionService{DB: db, Logger: logger, TTL: conf.Auth.SessionTTL.Duration}
+	usersController, err := controllers.NewUsers(logger, userService, sessionService, tokenService)
+	if err != nil {
+		panic(err)
+	}
+	usersController.AllowSignup = conf.Auth.AllowSignup
+	usersController.Templates.SignIn =
+		views.Must(views.ParseFS(templates.FS, logger, "main-layout.gohtml", "signin.gohtml"))
+	usersController.Templates.Setup =
+		views.Must(views.ParseFS(templates.FS, logger, "main-layout.gohtml", "setup.gohtml"))
+	oidcController, err := controllers.NewOIDC(logger, usersController)
+	if err != nil {
+		panic(err)
+	}
+	if oidc := conf.Auth.OIDC; oidc.Issuer != "" {
+		oidcController.Issuer = oidc.Issuer
+		oidcController.ClientID = oidc.ClientID
+		oidcController.ClientSecret = oidc.ClientSecret
+		oidcController.RedirectURL = oidc.RedirectURL
+		oidcController.CreateUsers = !oidc.DisableUserCreation
+		usersController.OIDCLabel = oidc.Label
+		settingsController.OIDCLabel = oidc.Label
+	}
 
 	r := chi.NewRouter()
-	r.Get("/", weatherController.Main)
-	r.Get("/cities", weatherController.Cities)
-	r.Post("/cities", weatherController.FindCities)
-	r.Post("/addCity", weatherController.AddCity)
-	r.Get("/manage", weatherController.Manage)
-	r.Post("/deleteLocation", weatherController.DeleteLocation)
+	r.Use(controllers.SecurityHeaders)
+	if conf.Auth.Enabled {
+		r.Use(usersController.SetUser)
+		r.Get("/signin", usersController.SignIn)
+		r.Post("/signin", usersController.ProcessSignIn)
+		r.Post("/signout", usersController.SignOut)
+		r.Get("/setup", usersController.Setup)
+		r.Post("/setup", usersController.ProcessSetup)
+		r.Get("/signup", usersController.Signup)
+		r.Post("/signup", usersController.ProcessSignup)
+		if conf.Auth.OIDC.Issuer != "" {
+			r.Get("/auth/oidc", oidcController.Start)
+			r.Get("/auth/oidc/callback", oidcController.Callback)
+		}
+	}
+	r.Handle("/static/*", static.Handler())
+	r.Get("/settings", settingsController.Settings)
+	r.Post("/settings", settingsController.SavePreferences)
+	r.Group(func(r chi.Router) {
+		// each user has their own locations, there's nothing to show without one
+		if conf.Auth.Enabled {
+			r.Use(usersController.RequireUser)
+		}
+		r.Get("/", weatherController.Main)
+		r.Get("/alerts", weatherController.Alerts)
+		r.Get("/cities", weatherController.Cities)
+		r.Post("/cities", weatherController.FindCities)
+		r.Post("/cities/zip", weatherController.FindCitiesByZip)
+		r.Post("/cities/coordinates", weatherController.FindCitiesByCoordinates)
+		r.Post("/addCity", weatherController.AddCity)
+		r.Get("/manage", weatherController.Manage)
+		r.Post("/deleteLocation", weatherController.DeleteLocation)
+		r.Group(func(r chi.Router) {
+			// the rules, sinks and webhooks are the admin's, and rule states
+			// name places from every user's locations
+			if conf.Auth.Enabled {
+				r.Use(usersController.RequireAdmin)
+			}
+			r.Get("/notifications", notificationsController.Notifications)
+			r.Post("/notifications/test", notificationsController.SendTest)
+			r.Get("/admin/webhooks", webhooksController.Webhooks)
+		})
+		r.Post("/settings/tokens", settingsController.CreateAPIToken)
+		r.Post("/settings/tokens/revoke", settingsController.RevokeAPIToken)
+	})
+	r.Get("/weatherstation/updateweatherstation.php", weatherController.WundergroundUpload)
+	r.Post("/data/report", weatherController.EcowittUpload)
+	r.Post("/data/report/", weatherController.EcowittUpload)
+	// the JSON API answers to API tokens as well as sessions, so it sits
+	// outside the pages' RequireUser group
+	r.Group(func(r chi.Router) {
+		if conf.Auth.Enabled {
+			r.Use(usersController.RequireScope(models.ScopeRead))
+		}
+		r.Get("/api/locations", weatherController.APILocations)
+	})
+	r.Group(func(r chi.Router) {
+		if conf.Auth.Enabled {
+			r.Use(usersController.RequireScope(models.ScopeManage))
+		}
+		r.Post("/api/locations", weatherController.APIAddLocation)
+		r.Delete("/api/locations/{id}", weatherController.APIDeleteLocation)
+	})
 
-	if err := http.ListenAndServe(":1117", r); err != nil {
+	if err := serve(ctx, conf.Server, r, logger); err != nil {
 		logger.Error("Failed to start server", slog.Any("error", err))
 		panic(fmt.Errorf("Failed to start server: %w", err))
 	}
+	// deliveries stop with ctx, let them record it before exiting
+	webhookDispatcher.Wait()
+	logger.Info("Personal Weather stopped")
 }
 
 type SlogGooseLogger struct {
@@ -0,0 +1,28 @@
+-- +goose Up
+CREATE TABLE geonames (
+                       id INTEGER PRIMARY KEY,
+                       name TEXT NOT NULL,
+                       latitude REAL NOT NULL,
+                       longitude REAL NOT NULL,
+                       country TEXT NOT NULL DEFAULT '',
+                       admin1 TEXT NOT NULL DEFAULT '',
+                       population INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX geonames_coordinates ON geonames (latitude, longitude);
+
+CREATE TABLE geonames_names (
+                       geoname_id INTEGER NOT NULL,
+                       search_name TEXT NOT NULL,
+                       PRIMARY KEY (search_name, geoname_id)
+) WITHOUT ROWID;
+
+CREATE TABLE geonames_source (
+                       path TEXT NOT NULL,
+                       size INTEGER NOT NULL,
+                       mod_time TEXT NOT NULL
+);
+
+-- +goose Down
+DROP TABLE geonames_source;
+DROP TABLE geonames_names;
+DROP TABLE geonames;
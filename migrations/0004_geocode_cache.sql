@@ -0,0 +1,9 @@
+-- +goose Up
+CREATE TABLE geocode_cache (
+                       query TEXT PRIMARY KEY,
+                       results TEXT NOT NULL,
+                       expires TEXT NOT NULL
+);
+
+-- +goose Down
+DROP TABLE geocode_cache;
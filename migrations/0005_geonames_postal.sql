@@ -0,0 +1,16 @@
+-- +goose Up
+CREATE TABLE geonames_postal (
+                       id INTEGER PRIMARY KEY AUTOINCREMENT,
+                       country TEXT NOT NULL,
+                       postal_code TEXT NOT NULL,
+                       place_name TEXT NOT NULL,
+                       admin1 TEXT NOT NULL DEFAULT '',
+                       latitude REAL NOT NULL,
+                       longitude REAL NOT NULL
+);
+CREATE INDEX geonames_postal_code ON geonames_postal (postal_code, country);
+ALTER TABLE geonames_source ADD COLUMN dataset TEXT NOT NULL DEFAULT 'cities';
+
+-- +goose Down
+ALTER TABLE geonames_source DROP COLUMN dataset;
+DROP TABLE geonames_postal;
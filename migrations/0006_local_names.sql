@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE locations ADD COLUMN local_names TEXT NOT NULL DEFAULT '{}';
+
+-- +goose Down
+ALTER TABLE locations DROP COLUMN local_names;
@@ -0,0 +1,13 @@
+-- +goose Up
+ALTER TABLE locations ADD COLUMN feels_like REAL NOT NULL DEFAULT 0.0;
+ALTER TABLE locations ADD COLUMN humidity REAL NOT NULL DEFAULT 0.0;
+ALTER TABLE locations ADD COLUMN pressure REAL NOT NULL DEFAULT 0.0;
+ALTER TABLE locations ADD COLUMN wind_speed REAL NOT NULL DEFAULT 0.0;
+ALTER TABLE locations ADD COLUMN observed_at TEXT NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE locations DROP COLUMN observed_at;
+ALTER TABLE locations DROP COLUMN wind_speed;
+ALTER TABLE locations DROP COLUMN pressure;
+ALTER TABLE locations DROP COLUMN humidity;
+ALTER TABLE locations DROP COLUMN feels_like;
@@ -0,0 +1,8 @@
+-- +goose Up
+-- readings so far were requested in imperial units
+ALTER TABLE locations ADD COLUMN temp_unit TEXT NOT NULL DEFAULT 'F';
+ALTER TABLE locations ADD COLUMN wind_unit TEXT NOT NULL DEFAULT 'mph';
+
+-- +goose Down
+ALTER TABLE locations DROP COLUMN wind_unit;
+ALTER TABLE locations DROP COLUMN temp_unit;
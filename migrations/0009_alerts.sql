@@ -0,0 +1,15 @@
+-- +goose Up
+CREATE TABLE alerts (
+                       id INTEGER PRIMARY KEY AUTOINCREMENT,
+                       location_id INTEGER NOT NULL,
+                       sender TEXT NOT NULL DEFAULT '',
+                       event TEXT NOT NULL,
+                       start TEXT NOT NULL,
+                       end TEXT NOT NULL,
+                       description TEXT NOT NULL DEFAULT '',
+                       UNIQUE (location_id, sender, event, start)
+);
+CREATE INDEX alerts_end ON alerts (end);
+
+-- +goose Down
+DROP TABLE alerts;
@@ -0,0 +1,13 @@
+-- +goose Up
+CREATE TABLE rule_state (
+                       rule TEXT NOT NULL,
+                       location_id INTEGER NOT NULL,
+                       state TEXT NOT NULL,
+                       since TEXT NOT NULL,
+                       notified INTEGER NOT NULL DEFAULT 0,
+                       last_notified TEXT NOT NULL DEFAULT '',
+                       PRIMARY KEY (rule, location_id)
+);
+
+-- +goose Down
+DROP TABLE rule_state;
@@ -0,0 +1,16 @@
+-- +goose Up
+CREATE TABLE webhook_deliveries (
+                       id INTEGER PRIMARY KEY AUTOINCREMENT,
+                       webhook TEXT NOT NULL,
+                       location_id INTEGER NOT NULL,
+                       status TEXT NOT NULL,
+                       attempts INTEGER NOT NULL DEFAULT 0,
+                       response_code INTEGER NOT NULL DEFAULT 0,
+                       error TEXT NOT NULL DEFAULT '',
+                       created_at TEXT NOT NULL,
+                       updated_at TEXT NOT NULL
+);
+CREATE INDEX webhook_deliveries_created_at ON webhook_deliveries (created_at);
+
+-- +goose Down
+DROP TABLE webhook_deliveries;
@@ -0,0 +1,11 @@
+-- +goose Up
+-- provider is where readings come from, "openweathermap" or "station" for
+-- personal weather stations that push their own
+ALTER TABLE locations ADD COLUMN provider TEXT NOT NULL DEFAULT 'openweathermap';
+ALTER TABLE locations ADD COLUMN station_id TEXT NOT NULL DEFAULT '';
+CREATE UNIQUE INDEX locations_station_id ON locations (station_id) WHERE provider = 'station';
+
+-- +goose Down
+DROP INDEX locations_station_id;
+ALTER TABLE locations DROP COLUMN station_id;
+ALTER TABLE locations DROP COLUMN provider;
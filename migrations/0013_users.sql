@@ -0,0 +1,17 @@
+-- +goose Up
+CREATE TABLE users (
+                       id INTEGER PRIMARY KEY AUTOINCREMENT,
+                       username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+                       password_hash TEXT NOT NULL,
+                       created_at TEXT NOT NULL
+);
+CREATE TABLE sessions (
+                       token_hash TEXT PRIMARY KEY,
+                       user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+                       expires_at TEXT NOT NULL
+);
+CREATE INDEX sessions_user_id ON sessions (user_id);
+
+-- +goose Down
+DROP TABLE sessions;
+DROP TABLE users;
@@ -0,0 +1,11 @@
+-- +goose Up
+-- locations saved so far go to the first user, who also owns every location
+-- while authentication is off
+ALTER TABLE locations ADD COLUMN user_id INTEGER NOT NULL DEFAULT 1;
+CREATE INDEX locations_user_id ON locations (user_id);
+CREATE INDEX locations_coordinates ON locations (latitude, longitude);
+
+-- +goose Down
+DROP INDEX locations_coordinates;
+DROP INDEX locations_user_id;
+ALTER TABLE locations DROP COLUMN user_id;
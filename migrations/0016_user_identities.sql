@@ -0,0 +1,13 @@
+-- +goose Up
+-- identities from an OpenID Connect provider, subject is only unique per issuer
+CREATE TABLE user_identities (
+                       issuer TEXT NOT NULL,
+                       subject TEXT NOT NULL,
+                       user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+                       email TEXT NOT NULL DEFAULT '',
+                       created_at TEXT NOT NULL,
+                       PRIMARY KEY (issuer, subject)
+);
+
+-- +goose Down
+DROP TABLE user_identities;
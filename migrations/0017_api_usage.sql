@@ -0,0 +1,12 @@
+-- +goose Up
+-- calls made to each weather provider per UTC day, so the daily budget
+-- survives restarts
+CREATE TABLE api_usage (
+                       provider TEXT NOT NULL,
+                       day TEXT NOT NULL,
+                       calls INTEGER NOT NULL DEFAULT 0,
+                       PRIMARY KEY (provider, day)
+);
+
+-- +goose Down
+DROP TABLE api_usage;
@@ -0,0 +1,7 @@
+-- +goose Up
+-- set while a request is fetching new conditions for the location, so other
+-- requests and servers sharing the database don't fetch them too
+ALTER TABLE locations ADD COLUMN claimed_until TEXT NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE locations DROP COLUMN claimed_until;
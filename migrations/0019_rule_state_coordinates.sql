@@ -0,0 +1,34 @@
+-- +goose Up
+-- rules are evaluated once per place, users with a location at the same
+-- coordinates share the state so they aren't notified once each
+CREATE TABLE rule_state_coordinates (
+                       rule TEXT NOT NULL,
+                       latitude REAL NOT NULL,
+                       longitude REAL NOT NULL,
+                       state TEXT NOT NULL,
+                       since TEXT NOT NULL,
+                       notified INTEGER NOT NULL DEFAULT 0,
+                       last_notified TEXT NOT NULL DEFAULT '',
+                       PRIMARY KEY (rule, latitude, longitude)
+);
+INSERT OR IGNORE INTO rule_state_coordinates (rule, latitude, longitude, state, since, notified, last_notified)
+    SELECT r.rule, l.latitude, l.longitude, r.state, r.since, r.notified, r.last_notified
+    FROM rule_state r JOIN locations l ON l.id = r.location_id ORDER BY r.last_notified DESC;
+DROP TABLE rule_state;
+ALTER TABLE rule_state_coordinates RENAME TO rule_state;
+
+-- +goose Down
+CREATE TABLE rule_state_locations (
+                       rule TEXT NOT NULL,
+                       location_id INTEGER NOT NULL,
+                       state TEXT NOT NULL,
+                       since TEXT NOT NULL,
+                       notified INTEGER NOT NULL DEFAULT 0,
+                       last_notified TEXT NOT NULL DEFAULT '',
+                       PRIMARY KEY (rule, location_id)
+);
+INSERT INTO rule_state_locations (rule, location_id, state, since, notified, last_notified)
+    SELECT r.rule, l.id, r.state, r.since, r.notified, r.last_notified
+    FROM rule_state r JOIN locations l ON l.latitude = r.latitude AND l.longitude = r.longitude;
+DROP TABLE rule_state;
+ALTER TABLE rule_state_locations RENAME TO rule_state;
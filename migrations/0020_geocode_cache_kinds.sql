@@ -0,0 +1,7 @@
+-- +goose Up
+-- city keys now start with their kind like postal code keys do, a city
+-- search for "zip" could have cached postal code results
+DELETE FROM geocode_cache;
+
+-- +goose Down
+DELETE FROM geocode_cache;
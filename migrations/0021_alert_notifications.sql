@@ -0,0 +1,16 @@
+-- +goose Up
+-- which alerts each alert rule notified about at a place, so a restart
+-- doesn't send them again and quiet hours can hold them back
+CREATE TABLE alert_notifications (
+                       rule TEXT NOT NULL,
+                       latitude REAL NOT NULL,
+                       longitude REAL NOT NULL,
+                       sender TEXT NOT NULL,
+                       event TEXT NOT NULL,
+                       start TEXT NOT NULL,
+                       until TEXT NOT NULL,
+                       PRIMARY KEY (rule, latitude, longitude, sender, event, start)
+);
+
+-- +goose Down
+DROP TABLE alert_notifications;
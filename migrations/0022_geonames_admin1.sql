@@ -0,0 +1,14 @@
+-- +goose Up
+-- state and province names for the admin1 codes in geonames, keyed like
+-- admin1CodesASCII.txt, e.g. "US.MN"
+CREATE TABLE geonames_admin1 (
+                       code TEXT PRIMARY KEY,
+                       name TEXT NOT NULL,
+                       -- name and the ASCII name as normalizeAdmin1Name
+                       -- leaves them, for searching
+                       search_name TEXT NOT NULL,
+                       ascii_search_name TEXT NOT NULL
+);
+
+-- +goose Down
+DROP TABLE geonames_admin1;
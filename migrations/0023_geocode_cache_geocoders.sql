@@ -0,0 +1,7 @@
+-- +goose Up
+-- keys now start with the geocoder that answered, the old ones could be
+-- from either
+DELETE FROM geocode_cache;
+
+-- +goose Down
+DELETE FROM geocode_cache;
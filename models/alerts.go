@@ -0,0 +1,130 @@
+package models
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Alert is a severe weather alert issued for a location, e.g. a winter storm
+// warning from the national weather service.
+type Alert struct {
+	ID          int
+	LocationID  int
+	City        string
+	State       string
+	Country     string
+	Sender      string
+	Event       string
+	Start       time.Time
+	End         time.Time
+	Description string
+}
+
+// alerts that ended longer ago than this are deleted
+const alertRetention = 7 * 24 * time.Hour
+
+// SaveAlerts stores the alerts for a location. The provider sends every alert
+// that's still in effect on every refresh, so an alert already stored (same
+// sender, event and start) is updated instead of added again. It returns the
+// alerts that weren't seen before.
+func (ws *WeatherService) SaveAlerts(ctx context.Context, locationID int, alerts []Alert) ([]Alert, error) {
+	tx, err := ws.DB.BeginTx(ctx, nil)
+	if err != nil {
+		ws.Logger.Error("Failed to start saving alerts", slog.Int("location_id", locationID), slog.String("error", err.Error()))
+		return nil, err
+	}
+	defer tx.Rollback()
+	newAlerts := make([]Alert, 0)
+	for _, alert := range alerts {
+		start := alert.Start.Format(time.DateTime)
+		result, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO alerts (location_id, sender, event, start, end, description) VALUES (?, ?, ?, ?, ?, ?)`,
+			locationID, alert.Sender, alert.Event, start, alert.End.Format(time.DateTime), alert.Description)
+		if err != nil {
+			ws.Logger.Error("Failed to save alert", slog.Int("location_id", locationID), slog.String("event", alert.Event),
+				slog.String("error", err.Error()))
+			return nil, err
+		}
+		inserted, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if inserted == 1 {
+			id, err := result.LastInsertId()
+			if err != nil {
+				return nil, err
+			}
+			alert.ID = int(id)
+			alert.LocationID = locationID
+			newAlerts = append(newAlerts, alert)
+			continue
+		}
+		// already known, the end time and wording can change while it's in effect
+		_, err = tx.ExecContext(ctx, `UPDATE alerts SET end = ?, description = ? WHERE location_id = ? AND sender = ? AND event = ? AND start = ?`,
+			alert.End.Format(time.DateTime), alert.Description, locationID, alert.Sender, alert.Event, start)
+		if err != nil {
+			ws.Logger.Error("Failed to update alert", slog.Int("location_id", locationID), slog.String("event", alert.Event),
+				slog.String("error", err.Error()))
+			return nil, err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM alerts WHERE end < ?`, time.Now().Add(-alertRetention).Format(time.DateTime))
+	if err != nil {
+		ws.Logger.Error("Failed to delete old alerts", slog.String("error", err.Error()))
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		ws.Logger.Error("Failed to commit alerts", slog.Int("location_id", locationID), slog.String("error", err.Error()))
+		return nil, err
+	}
+	if len(newAlerts) > 0 {
+		ws.Logger.Info("New alerts saved", slog.Int("location_id", locationID), slog.Int("count", len(newAlerts)))
+	}
+	return newAlerts, nil
+}
+
+// GetActiveAlerts returns the alerts for the user's locations and the stations
+// that haven't ended yet, soonest ending first.
+func (ws *WeatherService) GetActiveAlerts(ctx context.Context, userID int) ([]Alert, error) {
+	return ws.queryActiveAlerts(ctx, `l.user_id IN (?, ?)`, userID, StationUserID)
+}
+
+// GetLocationAlerts returns the location's alerts that haven't ended yet,
+// soonest ending first.
+func (ws *WeatherService) GetLocationAlerts(ctx context.Context, locationID int) ([]Alert, error) {
+	return ws.queryActiveAlerts(ctx, `a.location_id = ?`, locationID)
+}
+
+// queryActiveAlerts returns the alerts that haven't ended yet of the
+// locations where matches.
+func (ws *WeatherService) queryActiveAlerts(ctx context.Context, where string, args ...any) ([]Alert, error) {
+	query := `SELECT a.id, a.location_id, l.city, l.state, l.country, a.sender, a.event, a.start, a.end, a.description
+		FROM alerts a JOIN locations l ON l.id = a.location_id
+		WHERE ` + where + ` AND a.end > ? ORDER BY a.end, a.id`
+	rows, err := ws.DB.QueryContext(ctx, query, append(args, time.Now().Format(time.DateTime))...)
+	if err != nil {
+		ws.Logger.Error("Failed to get active alerts", slog.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := make([]Alert, 0)
+	for rows.Next() {
+		var alert Alert
+		var start, end string
+		err := rows.Scan(&alert.ID, &alert.LocationID, &alert.City, &alert.State, &alert.Country, &alert.Sender,
+			&alert.Event, &start, &end, &alert.Description)
+		if err != nil {
+			ws.Logger.Error("Failed to scan alert row", slog.String("error", err.Error()))
+			return nil, err
+		}
+		alert.Start, _ = time.ParseInLocation(time.DateTime, start, time.Local)
+		alert.End, _ = time.ParseInLocation(time.DateTime, end, time.Local)
+		alerts = append(alerts, alert)
+	}
+	if err = rows.Err(); err != nil {
+		ws.Logger.Error("Error iterating over alert rows", slog.String("error", err.Error()))
+		return nil, err
+	}
+	return alerts, nil
+}
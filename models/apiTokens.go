@@ -0,0 +1,141 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// ScopeRead tokens can read locations and conditions
+	ScopeRead = "read"
+	// ScopeManage tokens can also add and delete locations
+	ScopeManage = "manage"
+)
+
+var Scopes = []string{ScopeRead, ScopeManage}
+
+// apiTokenPrefix makes tokens easy to spot in scripts and secret scanners
+const apiTokenPrefix = "pw_"
+
+// APIToken lets scripts use the JSON API as a user. Only a hash of the token
+// is stored, it's shown once when created.
+type APIToken struct {
+	ID         int
+	UserID     int
+	Name       string
+	Scope      string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
+
+// Allows reports whether the token can be used for something needing scope.
+func (t *APIToken) Allows(scope string) bool {
+	return t.Scope == scope || t.Scope == ScopeManage
+}
+
+type APITokenService struct {
+	DB     *sql.DB
+	Logger *slog.Logger
+}
+
+// Create makes a token for the user and returns it, it can't be looked up later.
+func (ts *APITokenService) Create(ctx context.Context, userID int, name, scope string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("token name is required")
+	}
+	if !slices.Contains(Scopes, scope) {
+		return "", fmt.Errorf("unknown scope %q", scope)
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	_, err := ts.DB.ExecContext(ctx, `INSERT INTO api_tokens (user_id, name, token_hash, scope, created_at) VALUES (?, ?, ?, ?, ?)`,
+		userID, name, hashToken(token), scope, time.Now().Format(time.DateTime))
+	if err != nil {
+		ts.Logger.Error("Failed to create API token", slog.Int("user_id", userID), slog.String("error", err.Error()))
+		return "", err
+	}
+	ts.Logger.Info("API token created", slog.Int("user_id", userID), slog.String("name", name), slog.String("scope", scope))
+	return token, nil
+}
+
+func (ts *APITokenService) List(ctx context.Context, userID int) ([]APIToken, error) {
+	rows, err := ts.DB.QueryContext(ctx, `SELECT id, user_id, name, scope, created_at, last_used_at FROM api_tokens
+		WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		ts.Logger.Error("Failed to get API tokens", slog.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := make([]APIToken, 0)
+	for rows.Next() {
+		var token APIToken
+		var createdAt, lastUsedAt string
+		err := rows.Scan(&token.ID, &token.UserID, &token.Name, &token.Scope, &createdAt, &lastUsedAt)
+		if err != nil {
+			ts.Logger.Error("Failed to scan API token row", slog.String("error", err.Error()))
+			return nil, err
+		}
+		token.CreatedAt, _ = time.ParseInLocation(time.DateTime, createdAt, time.Local)
+		if lastUsedAt != "" {
+			token.LastUsedAt, _ = time.ParseInLocation(time.DateTime, lastUsedAt, time.Local)
+		}
+		tokens = append(tokens, token)
+	}
+	if err = rows.Err(); err != nil {
+		ts.Logger.Error("Error iterating over API token rows", slog.String("error", err.Error()))
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Revoke deletes one of the user's tokens.
+func (ts *APITokenService) Revoke(ctx context.Context, userID, id int) error {
+	result, err := ts.DB.ExecContext(ctx, `DELETE FROM api_tokens WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		ts.Logger.Error("Failed to revoke API token", slog.Int("id", id), slog.String("error", err.Error()))
+		return err
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		return fmt.Errorf("no API token found with id %d", id)
+	}
+	ts.Logger.Info("API token revoked", slog.Int("id", id), slog.Int("user_id", userID))
+	return nil
+}
+
+// Authenticate returns the token and its user, nil when the token is unknown.
+func (ts *APITokenService) Authenticate(ctx context.Context, token string) (*User, *APIToken, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, nil, nil
+	}
+	var user User
+	var apiToken APIToken
+	err := ts.DB.QueryRowContext(ctx, `SELECT t.id, t.user_id, t.name, t.scope, u.username FROM api_tokens t
+		JOIN users u ON u.id = t.user_id WHERE t.token_hash = ?`, hashToken(token)).
+		Scan(&apiToken.ID, &apiToken.UserID, &apiToken.Name, &apiToken.Scope, &user.Username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		ts.Logger.Error("Failed to get API token", slog.String("error", err.Error()))
+		return nil, nil, err
+	}
+	user.ID = apiToken.UserID
+	apiToken.LastUsedAt = time.Now()
+	if _, err := ts.DB.ExecContext(ctx, `UPDATE api_tokens SET last_used_at = ? WHERE id = ?`,
+		apiToken.LastUsedAt.Format(time.DateTime), apiToken.ID); err != nil {
+		ts.Logger.Warn("Failed to record API token use", slog.Int("id", apiToken.ID), slog.String("error", err.Error()))
+	}
+	return &user, &apiToken, nil
+}
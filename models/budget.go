@@ -0,0 +1,205 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrBudgetExhausted is returned once the day's calls are used up
+	ErrBudgetExhausted = errors.New("daily weather API budget used up")
+	// ErrRateLimited is returned when calls come faster than the provider allows
+	ErrRateLimited = errors.New("weather API rate limit reached")
+)
+
+// BudgetedProvider keeps the calls to a provider within its free tier: a daily
+// budget counted in SQLite, so restarts don't reset it, and a token bucket
+// that spreads the calls out. The day starts at midnight UTC like the
+// provider's.
+type BudgetedProvider struct {
+	Provider ConditionsProvider
+	DB       *sql.DB
+	Logger   *slog.Logger
+	// Name is what the calls are counted under, e.g. "openweathermap"
+	Name       string
+	DailyLimit int
+	// PerMinute is how many calls the bucket refills each minute, it holds
+	// at most that many
+	PerMinute int
+
+	mu     sync.Mutex
+	tokens float64
+	filled time.Time
+}
+
+// APIUsage is how much of today's budget is used.
+type APIUsage struct {
+	Used int
+	// Limit is 0 when there's no daily limit
+	Limit int
+}
+
+func (u APIUsage) Remaining() int {
+	return max(u.Limit-u.Used, 0)
+}
+
+// Low is whether less than a tenth of the budget is left.
+func (u APIUsage) Low() bool {
+	return u.Remaining()*10 < u.Limit
+}
+
+// GetConditions charges the call before it's made, and each retry before it's
+// sent, so retries stop when a limit is reached.
+func (bp *BudgetedProvider) GetConditions(ctx context.Context, lat, lon float64) (*Conditions, error) {
+	var conditions *Conditions
+	err := bp.budgeted(ctx, func(ctx context.Context) error {
+		var err error
+		conditions, err = bp.Provider.GetConditions(ctx, lat, lon)
+		return err
+	})
+	return conditions, err
+}
+
+// budgeted makes a call to the provider's API, charging it and each of its
+// retries first.
+func (bp *BudgetedProvider) budgeted(ctx context.Context, call func(ctx context.Context) error) error {
+	if err := bp.charge(ctx); err != nil {
+		return err
+	}
+	err := call(withRetryHook(ctx, bp.charge))
+	if errors.Is(err, ErrCircuitOpen) {
+		// the provider was never called
+		bp.refund(ctx)
+	}
+	return err
+}
+
+// BudgetedGeocoder charges geocoding calls to the provider's budget, the
+// provider counts its geocoding API against the same quota as conditions.
+type BudgetedGeocoder struct {
+	Geocoder Geocoder
+	Budget   *BudgetedProvider
+}
+
+func (bg *BudgetedGeocoder) GetCityCoordinates(ctx context.Context, city, state, country string) ([]GeoLocation, error) {
+	return bg.geocode(ctx, func(ctx context.Context) ([]GeoLocation, error) {
+		return bg.Geocoder.GetCityCoordinates(ctx, city, state, country)
+	})
+}
+
+func (bg *BudgetedGeocoder) GetZipCoordinates(ctx context.Context, zip, country string) ([]GeoLocation, error) {
+	return bg.geocode(ctx, func(ctx context.Context) ([]GeoLocation, error) {
+		return bg.Geocoder.GetZipCoordinates(ctx, zip, country)
+	})
+}
+
+func (bg *BudgetedGeocoder) ReverseGeocode(ctx context.Context, lat, lon float64) ([]GeoLocation, error) {
+	return bg.geocode(ctx, func(ctx context.Context) ([]GeoLocation, error) {
+		return bg.Geocoder.ReverseGeocode(ctx, lat, lon)
+	})
+}
+
+func (bg *BudgetedGeocoder) geocode(ctx context.Context, lookup func(ctx context.Context) ([]GeoLocation, error)) ([]GeoLocation, error) {
+	var locations []GeoLocation
+	err := bg.Budget.budgeted(ctx, func(ctx context.Context) error {
+		var err error
+		locations, err = lookup(ctx)
+		return err
+	})
+	return locations, err
+}
+
+// charge takes a call from the rate limit and the day's budget, the token
+// goes back when the budget doesn't allow the call.
+func (bp *BudgetedProvider) charge(ctx context.Context) error {
+	if !bp.take() {
+		return ErrRateLimited
+	}
+	if err := bp.spend(ctx); err != nil {
+		bp.giveBack()
+		return err
+	}
+	return nil
+}
+
+// take removes a token from the bucket, false when it's empty.
+func (bp *BudgetedProvider) take() bool {
+	if bp.PerMinute <= 0 {
+		return true
+	}
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	now := time.Now()
+	if bp.filled.IsZero() {
+		bp.tokens = float64(bp.PerMinute)
+	} else {
+		bp.tokens = min(bp.tokens+now.Sub(bp.filled).Minutes()*float64(bp.PerMinute), float64(bp.PerMinute))
+	}
+	bp.filled = now
+	if bp.tokens < 1 {
+		return false
+	}
+	bp.tokens--
+	return true
+}
+
+// giveBack returns a token take removed for a call that wasn't made.
+func (bp *BudgetedProvider) giveBack() {
+	if bp.PerMinute <= 0 {
+		return
+	}
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.tokens = min(bp.tokens+1, float64(bp.PerMinute))
+}
+
+// spend counts a call against today's budget before it's made, failed calls
+// count too since the provider counts them.
+func (bp *BudgetedProvider) spend(ctx context.Context) error {
+	if bp.DailyLimit <= 0 {
+		return nil
+	}
+	result, err := bp.DB.ExecContext(ctx, `INSERT INTO api_usage (provider, day, calls) VALUES (?, ?, 1)
+		ON CONFLICT (provider, day) DO UPDATE SET calls = calls + 1 WHERE calls < ?`,
+		bp.Name, today(), bp.DailyLimit)
+	if err != nil {
+		bp.Logger.Error("Failed to count weather API call", slog.String("error", err.Error()))
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		bp.Logger.Warn("Weather API budget used up", slog.String("provider", bp.Name), slog.Int("limit", bp.DailyLimit))
+		return ErrBudgetExhausted
+	}
+	return nil
+}
+
+// refund takes back a call spend counted that wasn't made.
+func (bp *BudgetedProvider) refund(ctx context.Context) {
+	if bp.DailyLimit <= 0 {
+		return
+	}
+	_, err := bp.DB.ExecContext(ctx, `UPDATE api_usage SET calls = calls - 1 WHERE provider = ? AND day = ? AND calls > 0`,
+		bp.Name, today())
+	if err != nil {
+		bp.Logger.Error("Failed to refund weather API call", slog.String("error", err.Error()))
+	}
+}
+
+// Usage is how many calls were made today.
+func (bp *BudgetedProvider) Usage(ctx context.Context) (APIUsage, error) {
+	usage := APIUsage{Limit: max(bp.DailyLimit, 0)}
+	err := bp.DB.QueryRowContext(ctx, `SELECT calls FROM api_usage WHERE provider = ? AND day = ?`, bp.Name, today()).Scan(&usage.Used)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		bp.Logger.Error("Failed to get weather API usage", slog.String("error", err.Error()))
+		return usage, err
+	}
+	return usage, nil
+}
+
+func today() string {
+	return time.Now().UTC().Format(time.DateOnly)
+}
@@ -0,0 +1,130 @@
+package models
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyServer fails the first failures calls with a 503, then answers with
+// conditions.
+func flakyServer(t *testing.T, failures int32) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"lat": 48.1, "lon": 11.5, "current": {"dt": 1700000000, "temp": 4.5}}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func testBudgetedProvider(t *testing.T, server *httptest.Server, retries, dailyLimit int) *BudgetedProvider {
+	t.Helper()
+	api := testWeatherAPI(t, server, &ProviderClient{Retries: retries, Backoff: time.Millisecond})
+	return &BudgetedProvider{Provider: api, DB: openTestDB(t), Logger: testLogger(), Name: ProviderOpenWeatherMap,
+		DailyLimit: dailyLimit}
+}
+
+func TestRetriesSpendBudget(t *testing.T) {
+	server, calls := flakyServer(t, 2)
+	bp := testBudgetedProvider(t, server, 2, 10)
+	if _, err := bp.GetConditions(context.Background(), 48.1, 11.5); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := bp.Usage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 3 || usage.Used != 3 {
+		t.Errorf("made %d calls and counted %d, want 3 of each", n, usage.Used)
+	}
+}
+
+func TestRetriesStopAtBudget(t *testing.T) {
+	server, calls := flakyServer(t, 100)
+	bp := testBudgetedProvider(t, server, 5, 2)
+	if _, err := bp.GetConditions(context.Background(), 48.1, 11.5); err == nil {
+		t.Fatal("GetConditions succeeded against a failing server")
+	}
+	usage, err := bp.Usage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 2 || usage.Used != 2 {
+		t.Errorf("made %d calls and counted %d, want the limit of 2", n, usage.Used)
+	}
+}
+
+func TestRetriesTakeRateLimit(t *testing.T) {
+	server, calls := flakyServer(t, 100)
+	bp := testBudgetedProvider(t, server, 5, 100)
+	bp.PerMinute = 3
+	if _, err := bp.GetConditions(context.Background(), 48.1, 11.5); err == nil {
+		t.Fatal("GetConditions succeeded against a failing server")
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("made %d calls, want the 3 the bucket holds", n)
+	}
+	if _, err := bp.GetConditions(context.Background(), 48.1, 11.5); err != ErrRateLimited {
+		t.Errorf("GetConditions error = %v, want ErrRateLimited", err)
+	}
+}
+
+func TestBudgetRefusalKeepsToken(t *testing.T) {
+	server, calls := flakyServer(t, 0)
+	bp := testBudgetedProvider(t, server, 0, 1)
+	bp.PerMinute = 2
+	if _, err := bp.GetConditions(context.Background(), 48.1, 11.5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bp.GetConditions(context.Background(), 48.1, 11.5); err != ErrBudgetExhausted {
+		t.Fatalf("GetConditions error = %v, want ErrBudgetExhausted", err)
+	}
+	// the refused call didn't use the bucket's last token
+	bp.DailyLimit = 10
+	if _, err := bp.GetConditions(context.Background(), 48.1, 11.5); err != nil {
+		t.Fatalf("GetConditions error = %v after the budget was raised", err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("made %d calls, want 2", n)
+	}
+}
+
+func TestGeocodingSpendsBudget(t *testing.T) {
+	server, calls := flakyServer(t, 0)
+	bp := testBudgetedProvider(t, server, 0, 3)
+	bg := &BudgetedGeocoder{Geocoder: namingGeocoder{}, Budget: bp}
+	ctx := context.Background()
+	if _, err := bg.GetCityCoordinates(ctx, "Munich", "", "DE"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bg.GetZipCoordinates(ctx, "80331", "DE"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bg.ReverseGeocode(ctx, 48.1, 11.5); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := bp.Usage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Used != 3 {
+		t.Errorf("counted %d calls, want the 3 searches", usage.Used)
+	}
+	if _, err := bp.GetConditions(ctx, 48.1, 11.5); err != ErrBudgetExhausted {
+		t.Errorf("GetConditions error = %v, want ErrBudgetExhausted", err)
+	}
+	if _, err := bg.GetCityCoordinates(ctx, "Paris", "", "FR"); err != ErrBudgetExhausted {
+		t.Errorf("GetCityCoordinates error = %v, want ErrBudgetExhausted", err)
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("made %d conditions calls, want none", n)
+	}
+}
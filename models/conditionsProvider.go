@@ -0,0 +1,9 @@
+package models
+
+import "context"
+
+// ConditionsProvider fetches the current conditions at a point. OpenWeatherAPI
+// implements it and BudgetedProvider wraps it to limit the calls.
+type ConditionsProvider interface {
+	GetConditions(ctx context.Context, lat, lon float64) (*Conditions, error)
+}
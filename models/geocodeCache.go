@@ -0,0 +1,109 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CachedGeocoder keeps city search results in SQLite so repeated searches
+// don't cost a call to the wrapped Geocoder.
+type CachedGeocoder struct {
+	Geocoder Geocoder
+	// Name is the wrapped geocoder's, e.g. GeocoderGeoNames, entries cached
+	// by another geocoder aren't used after switching
+	Name   string
+	DB     *sql.DB
+	Logger *slog.Logger
+	TTL    time.Duration
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func (cg *CachedGeocoder) GetCityCoordinates(ctx context.Context, city, state, country string) ([]GeoLocation, error) {
+	return cg.cached(ctx, geocodeCacheKey(cg.Name, "city", city, state, country), func() ([]GeoLocation, error) {
+		return cg.Geocoder.GetCityCoordinates(ctx, city, state, country)
+	})
+}
+
+func (cg *CachedGeocoder) GetZipCoordinates(ctx context.Context, zip, country string) ([]GeoLocation, error) {
+	return cg.cached(ctx, geocodeCacheKey(cg.Name, "zip", zip, country), func() ([]GeoLocation, error) {
+		return cg.Geocoder.GetZipCoordinates(ctx, zip, country)
+	})
+}
+
+// ReverseGeocode isn't cached, every point is different
+func (cg *CachedGeocoder) ReverseGeocode(ctx context.Context, lat, lon float64) ([]GeoLocation, error) {
+	return cg.Geocoder.ReverseGeocode(ctx, lat, lon)
+}
+
+// cached answers from the cache when there's a live entry for key, otherwise
+// calls lookup and stores what it returns
+func (cg *CachedGeocoder) cached(ctx context.Context, key string, lookup func() ([]GeoLocation, error)) ([]GeoLocation, error) {
+	now := time.Now()
+	var results string
+	err := cg.DB.QueryRowContext(ctx, `SELECT results FROM geocode_cache WHERE query = ? AND expires > ?`,
+		key, now.Format(time.DateTime)).Scan(&results)
+	switch {
+	case err == nil:
+		locations := make([]GeoLocation, 0)
+		if err := json.Unmarshal([]byte(results), &locations); err == nil {
+			cg.hits.Add(1)
+			cg.logStats("Geocode cache hit", key)
+			return locations, nil
+		}
+		cg.Logger.Warn("Ignoring unreadable geocode cache entry", slog.String("query", key))
+	case !errors.Is(err, sql.ErrNoRows):
+		// a broken cache shouldn't stop the search
+		cg.Logger.Error("Failed to read geocode cache", slog.String("query", key), slog.Any("error", err))
+	}
+
+	cg.misses.Add(1)
+	cg.logStats("Geocode cache miss", key)
+	locations, err := lookup()
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(locations)
+	if err != nil {
+		cg.Logger.Error("Failed to encode geocode results", slog.String("query", key), slog.Any("error", err))
+		return locations, nil
+	}
+	_, err = cg.DB.ExecContext(ctx, `INSERT INTO geocode_cache (query, results, expires) VALUES (?, ?, ?)
+		ON CONFLICT (query) DO UPDATE SET results = excluded.results, expires = excluded.expires`,
+		key, string(encoded), now.Add(cg.TTL).Format(time.DateTime))
+	if err != nil {
+		cg.Logger.Error("Failed to write geocode cache", slog.String("query", key), slog.Any("error", err))
+		return locations, nil
+	}
+	if _, err := cg.DB.ExecContext(ctx, `DELETE FROM geocode_cache WHERE expires <= ?`, now.Format(time.DateTime)); err != nil {
+		cg.Logger.Warn("Failed to prune geocode cache", slog.Any("error", err))
+	}
+	return locations, nil
+}
+
+// Stats returns the number of cache hits and misses since startup.
+func (cg *CachedGeocoder) Stats() (hits, misses int64) {
+	return cg.hits.Load(), cg.misses.Load()
+}
+
+func (cg *CachedGeocoder) logStats(msg, key string) {
+	hits, misses := cg.Stats()
+	cg.Logger.Info(msg, slog.String("query", key), slog.Int64("hits", hits), slog.Int64("misses", misses))
+}
+
+// geocodeCacheKey starts with the geocoder and the kind of search, so a city
+// search can't get the results of a postal code search that joins to the
+// same key.
+func geocodeCacheKey(parts ...string) string {
+	for i, part := range parts {
+		parts[i] = strings.Join(strings.Fields(strings.ToLower(part)), " ")
+	}
+	return strings.Join(parts, "|")
+}
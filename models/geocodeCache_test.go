@@ -0,0 +1,103 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// namingGeocoder answers every search with a place named after the kind of
+// search.
+type namingGeocoder struct{}
+
+func (namingGeocoder) GetCityCoordinates(context.Context, string, string, string) ([]GeoLocation, error) {
+	return []GeoLocation{{Name: "city"}}, nil
+}
+
+func (namingGeocoder) GetZipCoordinates(context.Context, string, string) ([]GeoLocation, error) {
+	return []GeoLocation{{Name: "postal code"}}, nil
+}
+
+func (namingGeocoder) ReverseGeocode(context.Context, float64, float64) ([]GeoLocation, error) {
+	return []GeoLocation{{Name: "coordinates"}}, nil
+}
+
+func TestGeocodeCacheKeepsKindsApart(t *testing.T) {
+	cg := &CachedGeocoder{Geocoder: namingGeocoder{}, Name: ProviderOpenWeatherMap, DB: openTestDB(t), Logger: testLogger(), TTL: time.Hour}
+	ctx := context.Background()
+	// the postal code search is cached first, a city search joining to the
+	// same parts mustn't get it
+	zip, err := cg.GetZipCoordinates(ctx, "02134", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	city, err := cg.GetCityCoordinates(ctx, "zip", "02134", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zip) != 1 || zip[0].Name != "postal code" || len(city) != 1 || city[0].Name != "city" {
+		t.Errorf("postal code search found %v, city search found %v", zip, city)
+	}
+	if _, misses := cg.Stats(); misses != 2 {
+		t.Errorf("%d misses, want 2", misses)
+	}
+}
+
+// countingGeocoder counts the searches that reach it.
+type countingGeocoder struct {
+	namingGeocoder
+	calls int
+}
+
+func (g *countingGeocoder) GetCityCoordinates(ctx context.Context, city, state, country string) ([]GeoLocation, error) {
+	g.calls++
+	return g.namingGeocoder.GetCityCoordinates(ctx, city, state, country)
+}
+
+func TestGeocodeCache(t *testing.T) {
+	upstream := &countingGeocoder{}
+	db := openTestDB(t)
+	cg := &CachedGeocoder{Geocoder: upstream, Name: ProviderOpenWeatherMap, DB: db, Logger: testLogger(), TTL: time.Hour}
+	ctx := context.Background()
+	for _, step := range []struct {
+		what          string
+		city          string
+		calls         int
+		hits, misses  int64
+		expireEntries bool
+	}{
+		{what: "first search", city: "Boston", calls: 1, hits: 0, misses: 1},
+		{what: "same search typed differently", city: "  boston ", calls: 1, hits: 1, misses: 1},
+		{what: "another city", city: "Salem", calls: 2, hits: 1, misses: 2},
+		{what: "after the entries expired", city: "Boston", calls: 3, hits: 1, misses: 3, expireEntries: true},
+		{what: "cached again", city: "BOSTON", calls: 3, hits: 2, misses: 3},
+	} {
+		if step.expireEntries {
+			if _, err := db.Exec(`UPDATE geocode_cache SET expires = ?`, time.Now().Add(-time.Minute).Format(time.DateTime)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		locations, err := cg.GetCityCoordinates(ctx, step.city, "MA", "US")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(locations) != 1 || locations[0].Name != "city" {
+			t.Errorf("%s: found %v", step.what, locations)
+		}
+		if upstream.calls != step.calls {
+			t.Errorf("%s: %d upstream calls, want %d", step.what, upstream.calls, step.calls)
+		}
+		if hits, misses := cg.Stats(); hits != step.hits || misses != step.misses {
+			t.Errorf("%s: %d hits and %d misses, want %d and %d", step.what, hits, misses, step.hits, step.misses)
+		}
+	}
+
+	// switching geocoders doesn't answer from the other one's entries
+	geoNames := &CachedGeocoder{Geocoder: upstream, Name: GeocoderGeoNames, DB: db, Logger: testLogger(), TTL: time.Hour}
+	if _, err := geoNames.GetCityCoordinates(ctx, "Boston", "MA", "US"); err != nil {
+		t.Fatal(err)
+	}
+	if hits, _ := geoNames.Stats(); hits != 0 || upstream.calls != 4 {
+		t.Errorf("the other geocoder's entry was used, %d hits and %d upstream calls", hits, upstream.calls)
+	}
+}
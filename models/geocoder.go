@@ -0,0 +1,12 @@
+package models
+
+import "context"
+
+// Geocoder turns place names into coordinates and back. OpenWeatherAPI and
+// GeoNamesGeocoder both implement it so the controllers don't care where the
+// answers come from.
+type Geocoder interface {
+	GetCityCoordinates(ctx context.Context, city, state, country string) ([]GeoLocation, error)
+	GetZipCoordinates(ctx context.Context, zip, country string) ([]GeoLocation, error)
+	ReverseGeocode(ctx context.Context, lat, lon float64) ([]GeoLocation, error)
+}
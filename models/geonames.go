@@ -0,0 +1,477 @@
+package models
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// GeocoderGeoNames names the GeoNames geocoder, the weather provider's is
+// ProviderOpenWeatherMap
+const GeocoderGeoNames = "geonames"
+
+// GeoNamesGeocoder answers city searches from a local copy of a GeoNames
+// cities file (e.g. cities500.txt from https://download.geonames.org/export/dump/)
+// so searching keeps working without the weather provider.
+type GeoNamesGeocoder struct {
+	DB     *sql.DB
+	Logger *slog.Logger
+}
+
+const (
+	geoNamesResultLimit = 5
+	// geoNamesCandidateLimit is how many names a prefix search reads, more
+	// than the results since a place can match through several of its names
+	geoNamesCandidateLimit = 50
+	// geoNamesFuzzyLimit caps the names compared by edit distance, the most
+	// populous places are compared first
+	geoNamesFuzzyLimit = 2000
+	// geoNamesFuzzyMinLength is the shortest search that looks for close
+	// spellings, shorter ones would match almost every short name
+	geoNamesFuzzyMinLength = 4
+)
+
+// columns of the GeoNames "geoname" table dump, the file is tab separated
+const (
+	geoNamesColumnID             = 0
+	geoNamesColumnName           = 1
+	geoNamesColumnASCIIName      = 2
+	geoNamesColumnAlternateNames = 3
+	geoNamesColumnLatitude       = 4
+	geoNamesColumnLongitude      = 5
+	geoNamesColumnCountry        = 8
+	geoNamesColumnAdmin1         = 10
+	geoNamesColumnPopulation     = 14
+	geoNamesColumnCount          = 19
+)
+
+// columns of the GeoNames postal code dump, also tab separated
+const (
+	postalColumnCountry   = 0
+	postalColumnCode      = 1
+	postalColumnPlaceName = 2
+	postalColumnAdmin1    = 4
+	postalColumnLatitude  = 9
+	postalColumnLongitude = 10
+	postalColumnCount     = 11
+)
+
+// columns of the GeoNames admin1 codes file, also tab separated
+const (
+	admin1ColumnCode      = 0
+	admin1ColumnName      = 1
+	admin1ColumnASCIIName = 2
+	admin1ColumnCount     = 4
+)
+
+// geoNamesState is the state's name when the admin1 codes file is loaded and
+// its code when it isn't
+const geoNamesState = `COALESCE(a.name, g.admin1)`
+
+// geoNamesAdmin1Join finds the name of the place's state
+const geoNamesAdmin1Join = ` LEFT JOIN geonames_admin1 a ON a.code = g.country || '.' || g.admin1`
+
+// Import loads the GeoNames cities file into SQLite. The import is skipped
+// when the same file (by size and modification time) has already been loaded.
+func (g *GeoNamesGeocoder) Import(ctx context.Context, path string) error {
+	return g.importDataset(ctx, "cities", path, g.loadCities)
+}
+
+// ImportPostalCodes loads a GeoNames postal code file (e.g. allCountries.txt
+// from https://download.geonames.org/export/zip/) used by GetZipCoordinates.
+func (g *GeoNamesGeocoder) ImportPostalCodes(ctx context.Context, path string) error {
+	return g.importDataset(ctx, "postal", path, g.loadPostalCodes)
+}
+
+// ImportAdmin1Codes loads the GeoNames admin1 codes file (admin1CodesASCII.txt
+// from https://download.geonames.org/export/dump/), which names the states
+// the cities file only has codes for.
+func (g *GeoNamesGeocoder) ImportAdmin1Codes(ctx context.Context, path string) error {
+	return g.importDataset(ctx, "admin1", path, g.loadAdmin1Codes)
+}
+
+func (g *GeoNamesGeocoder) importDataset(ctx context.Context, dataset, path string, load func(tx *sql.Tx, scanner *bufio.Scanner) (int, error)) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		g.Logger.Error("Failed to stat GeoNames file", slog.String("path", path), slog.Any("error", err))
+		return err
+	}
+	modTime := info.ModTime().UTC().Format(time.DateTime)
+	var size int64
+	var loadedPath, loadedModTime string
+	err = g.DB.QueryRowContext(ctx, `SELECT path, size, mod_time FROM geonames_source WHERE dataset = ?`, dataset).
+		Scan(&loadedPath, &size, &loadedModTime)
+	if err == nil && loadedPath == path && size == info.Size() && loadedModTime == modTime {
+		g.Logger.Info("GeoNames file already imported", slog.String("dataset", dataset), slog.String("path", path))
+		return nil
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		g.Logger.Error("Failed to check GeoNames import", slog.Any("error", err))
+		return err
+	}
+
+	start := time.Now()
+	f, err := os.Open(path)
+	if err != nil {
+		g.Logger.Error("Failed to open GeoNames file", slog.String("path", path), slog.Any("error", err))
+		return err
+	}
+	defer f.Close()
+	// cancelling ctx rolls the import back, the loaders' statements fail after that
+	tx, err := g.DB.BeginTx(ctx, nil)
+	if err != nil {
+		g.Logger.Error("Failed to start GeoNames import", slog.Any("error", err))
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM geonames_source WHERE dataset = ?`, dataset); err != nil {
+		g.Logger.Error("Failed to clear previous GeoNames import", slog.Any("error", err))
+		return err
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	count, err := load(tx, scanner)
+	if err != nil {
+		return err
+	}
+	if err := scanner.Err(); err != nil {
+		g.Logger.Error("Failed to read GeoNames file", slog.String("path", path), slog.Any("error", err))
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO geonames_source (dataset, path, size, mod_time) VALUES (?, ?, ?, ?)`,
+		dataset, path, info.Size(), modTime)
+	if err != nil {
+		g.Logger.Error("Failed to record GeoNames import", slog.Any("error", err))
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		g.Logger.Error("Failed to commit GeoNames import", slog.Any("error", err))
+		return err
+	}
+	g.Logger.Info("GeoNames file imported", slog.String("dataset", dataset), slog.String("path", path),
+		slog.Int("rows", count), slog.Duration("took", time.Since(start)))
+	return nil
+}
+
+func (g *GeoNamesGeocoder) loadCities(tx *sql.Tx, scanner *bufio.Scanner) (int, error) {
+	for _, query := range []string{`DELETE FROM geonames_names`, `DELETE FROM geonames`} {
+		if _, err := tx.Exec(query); err != nil {
+			g.Logger.Error("Failed to clear previous GeoNames import", slog.Any("error", err))
+			return 0, err
+		}
+	}
+	placeStmt, err := tx.Prepare(`INSERT INTO geonames (id, name, latitude, longitude, country, admin1, population) VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return 0, err
+	}
+	defer placeStmt.Close()
+	nameStmt, err := tx.Prepare(`INSERT OR IGNORE INTO geonames_names (geoname_id, search_name) VALUES (?, ?)`)
+	if err != nil {
+		return 0, err
+	}
+	defer nameStmt.Close()
+
+	count := 0
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < geoNamesColumnCount {
+			continue
+		}
+		id, err := strconv.Atoi(fields[geoNamesColumnID])
+		if err != nil {
+			continue
+		}
+		lat, err := strconv.ParseFloat(fields[geoNamesColumnLatitude], 64)
+		if err != nil {
+			continue
+		}
+		lon, err := strconv.ParseFloat(fields[geoNamesColumnLongitude], 64)
+		if err != nil {
+			continue
+		}
+		population, _ := strconv.Atoi(fields[geoNamesColumnPopulation])
+		_, err = placeStmt.Exec(id, fields[geoNamesColumnName], lat, lon,
+			fields[geoNamesColumnCountry], fields[geoNamesColumnAdmin1], population)
+		if err != nil {
+			g.Logger.Error("Failed to insert GeoNames place", slog.Int("id", id), slog.Any("error", err))
+			return 0, err
+		}
+		names := []string{fields[geoNamesColumnName], fields[geoNamesColumnASCIIName]}
+		if fields[geoNamesColumnAlternateNames] != "" {
+			names = append(names, strings.Split(fields[geoNamesColumnAlternateNames], ",")...)
+		}
+		for _, name := range names {
+			name = normalizeGeoName(name)
+			if name == "" {
+				continue
+			}
+			if _, err := nameStmt.Exec(id, name); err != nil {
+				g.Logger.Error("Failed to insert GeoNames name", slog.Int("id", id), slog.Any("error", err))
+				return 0, err
+			}
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (g *GeoNamesGeocoder) loadPostalCodes(tx *sql.Tx, scanner *bufio.Scanner) (int, error) {
+	if _, err := tx.Exec(`DELETE FROM geonames_postal`); err != nil {
+		g.Logger.Error("Failed to clear previous GeoNames postal codes", slog.Any("error", err))
+		return 0, err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO geonames_postal (country, postal_code, place_name, admin1, latitude, longitude) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	count := 0
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < postalColumnCount {
+			continue
+		}
+		lat, err := strconv.ParseFloat(fields[postalColumnLatitude], 64)
+		if err != nil {
+			continue
+		}
+		lon, err := strconv.ParseFloat(fields[postalColumnLongitude], 64)
+		if err != nil {
+			continue
+		}
+		_, err = stmt.Exec(fields[postalColumnCountry], normalizePostalCode(fields[postalColumnCode]),
+			fields[postalColumnPlaceName], fields[postalColumnAdmin1], lat, lon)
+		if err != nil {
+			g.Logger.Error("Failed to insert GeoNames postal code", slog.String("postal_code", fields[postalColumnCode]),
+				slog.Any("error", err))
+			return 0, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (g *GeoNamesGeocoder) loadAdmin1Codes(tx *sql.Tx, scanner *bufio.Scanner) (int, error) {
+	if _, err := tx.Exec(`DELETE FROM geonames_admin1`); err != nil {
+		g.Logger.Error("Failed to clear previous GeoNames admin1 codes", slog.Any("error", err))
+		return 0, err
+	}
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO geonames_admin1 (code, name, search_name, ascii_search_name) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	count := 0
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < admin1ColumnCount || fields[admin1ColumnName] == "" {
+			continue
+		}
+		_, err := stmt.Exec(fields[admin1ColumnCode], fields[admin1ColumnName], normalizeAdmin1Name(fields[admin1ColumnName]),
+			normalizeAdmin1Name(fields[admin1ColumnASCIIName]))
+		if err != nil {
+			g.Logger.Error("Failed to insert GeoNames admin1 code", slog.String("code", fields[admin1ColumnCode]),
+				slog.Any("error", err))
+			return 0, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// GetCityCoordinates searches by name prefix first and falls back to names
+// within a small edit distance so typos like "Pittsburg" still find something.
+// Searches shorter than geoNamesFuzzyMinLength only match by prefix. The
+// state can be its code ("MN") or, with the admin1 codes file loaded, its name
+// ("Minnesota"), either way ignoring case.
+func (g *GeoNamesGeocoder) GetCityCoordinates(ctx context.Context, city, state, country string) ([]GeoLocation, error) {
+	city = normalizeGeoName(city)
+	state = normalizeAdmin1Name(state)
+	country = strings.ToUpper(strings.TrimSpace(country))
+	if city == "" {
+		g.Logger.Error("City cannot be empty")
+		return nil, fmt.Errorf("city cannot be empty")
+	}
+	query := `SELECT g.id, g.name, g.latitude, g.longitude, g.country, ` + geoNamesState + `, g.population, n.search_name
+		FROM geonames_names n JOIN geonames g ON g.id = n.geoname_id` + geoNamesAdmin1Join + `
+		WHERE n.search_name >= ? AND n.search_name < ?
+		AND (? = '' OR g.country = ?) AND (? = '' OR g.admin1 = ? OR a.search_name = ? OR a.ascii_search_name = ?)`
+	// exact names first, then the biggest places
+	matches, err := g.queryPlaces(ctx, query+` ORDER BY n.search_name = ? DESC, g.population DESC LIMIT ?`,
+		city, city+"\uffff", country, country, state, state, state, state, city, geoNamesCandidateLimit)
+	if err != nil {
+		return nil, err
+	}
+	length := utf8.RuneCountInString(city)
+	if len(matches) == 0 && length >= geoNamesFuzzyMinLength {
+		// nothing starts with what was typed, look for close spellings sharing the first letter
+		first, _ := utf8.DecodeRuneInString(city)
+		prefix := string(first)
+		maxDistance := max(1, length/4)
+		matches, err = g.queryPlaces(ctx, query+` AND length(n.search_name) BETWEEN ? AND ? ORDER BY g.population DESC LIMIT ?`,
+			prefix, prefix+"\uffff", country, country, state, state, state, state, length-maxDistance, length+maxDistance, geoNamesFuzzyLimit)
+		if err != nil {
+			return nil, err
+		}
+		fuzzy := matches[:0]
+		for _, m := range matches {
+			if levenshtein(city, m.searchName) <= maxDistance {
+				fuzzy = append(fuzzy, m)
+			}
+		}
+		matches = fuzzy
+	}
+	return topGeoLocations(matches), nil
+}
+
+// ReverseGeocode returns the closest places to the coordinates, searching a
+// box of about 50km around the point.
+func (g *GeoNamesGeocoder) ReverseGeocode(ctx context.Context, lat, lon float64) ([]GeoLocation, error) {
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		g.Logger.Error("Coordinates out of range", slog.Float64("latitude", lat), slog.Float64("longitude", lon))
+		return nil, fmt.Errorf("coordinates out of range")
+	}
+	const delta = 0.5
+	query := `SELECT g.id, g.name, g.latitude, g.longitude, g.country, ` + geoNamesState + `, g.population, '' FROM geonames g` +
+		geoNamesAdmin1Join + ` WHERE g.latitude BETWEEN ? AND ? AND g.longitude BETWEEN ? AND ?`
+	matches, err := g.queryPlaces(ctx, query, lat-delta, lat+delta, lon-delta, lon+delta)
+	if err != nil {
+		return nil, err
+	}
+	distance := func(m geoNamesMatch) float64 {
+		dLat := m.location.Latitude - lat
+		dLon := (m.location.Longitude - lon) * math.Cos(lat*math.Pi/180)
+		return dLat*dLat + dLon*dLon
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return distance(matches[i]) < distance(matches[j])
+	})
+	return topGeoLocations(matches), nil
+}
+
+// GetZipCoordinates looks the postal code up in the imported postal code file.
+func (g *GeoNamesGeocoder) GetZipCoordinates(ctx context.Context, zip, country string) ([]GeoLocation, error) {
+	zip = normalizePostalCode(zip)
+	country = strings.ToUpper(strings.TrimSpace(country))
+	if zip == "" {
+		g.Logger.Error("Postal code cannot be empty")
+		return nil, fmt.Errorf("postal code cannot be empty")
+	}
+	var loaded int
+	if err := g.DB.QueryRowContext(ctx, `SELECT count(*) FROM geonames_source WHERE dataset = 'postal'`).Scan(&loaded); err != nil {
+		g.Logger.Error("Failed to check GeoNames postal import", slog.Any("error", err))
+		return nil, err
+	}
+	if loaded == 0 {
+		g.Logger.Error("Postal code search used without a GeoNames postal code file")
+		return nil, fmt.Errorf("postal code search needs geocoding.geonamesPostalFile to be configured")
+	}
+	query := `SELECT 0, g.place_name, g.latitude, g.longitude, g.country, ` + geoNamesState + `, 0, '' FROM geonames_postal g` +
+		geoNamesAdmin1Join + ` WHERE g.postal_code = ? AND (? = '' OR g.country = ?) ORDER BY g.country, g.place_name LIMIT ?`
+	matches, err := g.queryPlaces(ctx, query, zip, country, country, geoNamesResultLimit)
+	if err != nil {
+		return nil, err
+	}
+	locations := make([]GeoLocation, 0, len(matches))
+	for _, m := range matches {
+		locations = append(locations, m.location)
+	}
+	return locations, nil
+}
+
+type geoNamesMatch struct {
+	location   GeoLocation
+	population int
+	searchName string
+}
+
+func (g *GeoNamesGeocoder) queryPlaces(ctx context.Context, query string, args ...any) ([]geoNamesMatch, error) {
+	rows, err := g.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		g.Logger.Error("Failed to search GeoNames", slog.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+	matches := make([]geoNamesMatch, 0)
+	for rows.Next() {
+		var m geoNamesMatch
+		err := rows.Scan(&m.location.ID, &m.location.Name, &m.location.Latitude, &m.location.Longitude,
+			&m.location.Country, &m.location.State, &m.population, &m.searchName)
+		if err != nil {
+			g.Logger.Error("Failed to scan GeoNames row", slog.String("error", err.Error()))
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	if err = rows.Err(); err != nil {
+		g.Logger.Error("Error iterating over GeoNames rows", slog.String("error", err.Error()))
+		return nil, err
+	}
+	return matches, nil
+}
+
+// topGeoLocations keeps the first few distinct places, a place can match
+// through more than one of its names
+func topGeoLocations(matches []geoNamesMatch) []GeoLocation {
+	seen := make(map[int]bool)
+	locations := make([]GeoLocation, 0, geoNamesResultLimit)
+	for _, m := range matches {
+		if seen[m.location.ID] {
+			continue
+		}
+		seen[m.location.ID] = true
+		locations = append(locations, m.location)
+		if len(locations) == geoNamesResultLimit {
+			break
+		}
+	}
+	return locations
+}
+
+func normalizeGeoName(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), " ")
+}
+
+// normalizeAdmin1Name uppercases so codes ("mn") and names ("minnesota") match
+// however they're typed
+func normalizeAdmin1Name(name string) string {
+	return strings.ToUpper(normalizeGeoName(name))
+}
+
+// normalizePostalCode uppercases and drops spaces so "sw1a 1aa" matches "SW1A 1AA"
+func normalizePostalCode(zip string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(zip), ""))
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
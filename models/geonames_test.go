@@ -0,0 +1,131 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testGeoNames is a GeoNamesGeocoder with the places loaded, each name is
+// searchable by itself.
+func testGeoNames(t *testing.T, places map[string]int) *GeoNamesGeocoder {
+	t.Helper()
+	db := openTestDB(t)
+	id := 0
+	for name, population := range places {
+		id++
+		if _, err := db.Exec(`INSERT INTO geonames (id, name, latitude, longitude, country, admin1, population) VALUES (?, ?, 0, 0, 'US', 'MA', ?)`,
+			id, name, population); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(`INSERT INTO geonames_names (geoname_id, search_name) VALUES (?, ?)`, id, normalizeGeoName(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &GeoNamesGeocoder{DB: db, Logger: testLogger()}
+}
+
+func names(locations []GeoLocation) []string {
+	found := make([]string, 0, len(locations))
+	for _, location := range locations {
+		found = append(found, location.Name)
+	}
+	return found
+}
+
+func TestGeoNamesExactMatchFirst(t *testing.T) {
+	g := testGeoNames(t, map[string]int{"Springfield": 1000, "Springfield Gardens": 50000, "Springdale": 20000})
+	locations, err := g.GetCityCoordinates(context.Background(), "springfield", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(names(locations)); got != "[Springfield Springfield Gardens]" {
+		t.Errorf("found %s", got)
+	}
+	locations, err = g.GetCityCoordinates(context.Background(), "Spring", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(names(locations)); got != "[Springfield Gardens Springdale Springfield]" {
+		t.Errorf("found %s", got)
+	}
+}
+
+func TestGeoNamesLimit(t *testing.T) {
+	places := make(map[string]int)
+	for i := range geoNamesCandidateLimit * 2 {
+		places[fmt.Sprintf("Salem %03d", i)] = i
+	}
+	g := testGeoNames(t, places)
+	locations, err := g.GetCityCoordinates(context.Background(), "salem", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(names(locations)); got != "[Salem 099 Salem 098 Salem 097 Salem 096 Salem 095]" {
+		t.Errorf("found %s", got)
+	}
+}
+
+func TestGeoNamesFuzzy(t *testing.T) {
+	g := testGeoNames(t, map[string]int{"Pittsburgh": 300000, "Pit": 10})
+	locations, err := g.GetCityCoordinates(context.Background(), "Pitsburgh", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(names(locations)); got != "[Pittsburgh]" {
+		t.Errorf("found %s", got)
+	}
+	// too short to look for close spellings
+	locations, err = g.GetCityCoordinates(context.Background(), "Pot", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 0 {
+		t.Errorf("found %s", names(locations))
+	}
+}
+
+func TestGeoNamesAdmin1Names(t *testing.T) {
+	g := testGeoNames(t, map[string]int{"Boston": 600000})
+	search := func(state string) []GeoLocation {
+		t.Helper()
+		locations, err := g.GetCityCoordinates(context.Background(), "Boston", state, "US")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return locations
+	}
+	// without the admin1 codes file only the code is known
+	for state, want := range map[string]int{"": 1, " ma ": 1, "Massachusetts": 0} {
+		if locations := search(state); len(locations) != want {
+			t.Errorf("state %q found %d places, want %d", state, len(locations), want)
+		} else if want == 1 && locations[0].State != "MA" {
+			t.Errorf("state shown as %q, want the code", locations[0].State)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "admin1CodesASCII.txt")
+	codes := "US.MA\tMassachusetts\tMassachusetts\t6254926\nUS.MN\tMinnesota\tMinnesota\t5037779\n"
+	if err := os.WriteFile(path, []byte(codes), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.ImportAdmin1Codes(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	for state, want := range map[string]int{"": 1, "MA": 1, "massachusetts": 1, "Minnesota": 0} {
+		if locations := search(state); len(locations) != want {
+			t.Errorf("state %q found %d places, want %d", state, len(locations), want)
+		} else if want == 1 && locations[0].State != "Massachusetts" {
+			t.Errorf("state shown as %q, want the name", locations[0].State)
+		}
+	}
+	locations, err := g.ReverseGeocode(context.Background(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 1 || locations[0].State != "Massachusetts" {
+		t.Errorf("reverse lookup found %+v", locations)
+	}
+}
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// ErrUnknownIdentity is returned for an identity that isn't linked to a user
+// when new users can't be created for it.
+var ErrUnknownIdentity = errors.New("no user for this identity")
+
+// Identity is who an OpenID Connect provider says signed in.
+type Identity struct {
+	Issuer  string
+	Subject string
+	Email   string
+	// Username is the preferred_username claim, if the provider sends one
+	Username string
+}
+
+// noPassword can't be produced by bcrypt, users created for an identity can
+// only sign in through their provider
+const noPassword = "!"
+
+// UserForIdentity returns the user linked to the identity. An unlinked
+// identity is linked to linkTo when it's set, otherwise a new user is created
+// for it when create is true.
+func (us *UserService) UserForIdentity(ctx context.Context, identity Identity, linkTo *User, create bool) (*User, error) {
+	var user User
+	err := us.DB.QueryRowContext(ctx, `SELECT u.id, u.username FROM user_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.issuer = ? AND i.subject = ?`, identity.Issuer, identity.Subject).Scan(&user.ID, &user.Username)
+	if err == nil {
+		return &user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		us.Logger.Error("Failed to get user identity", slog.String("error", err.Error()))
+		return nil, err
+	}
+	target := linkTo
+	if target == nil {
+		if !create {
+			return nil, ErrUnknownIdentity
+		}
+		if target, err = us.createForIdentity(ctx, identity); err != nil {
+			return nil, err
+		}
+	}
+	_, err = us.DB.ExecContext(ctx, `INSERT INTO user_identities (issuer, subject, user_id, email, created_at) VALUES (?, ?, ?, ?, ?)`,
+		identity.Issuer, identity.Subject, target.ID, identity.Email, time.Now().Format(time.DateTime))
+	if err != nil {
+		us.Logger.Error("Failed to link user identity", slog.Int("user_id", target.ID), slog.String("error", err.Error()))
+		return nil, err
+	}
+	us.Logger.Info("User identity linked", slog.Int("user_id", target.ID), slog.String("issuer", identity.Issuer))
+	return target, nil
+}
+
+// createForIdentity makes a user named after the identity. A local user with
+// the same name is never taken over, the new user gets a number instead.
+func (us *UserService) createForIdentity(ctx context.Context, identity Identity) (*User, error) {
+	base := identity.Username
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	if base == "" {
+		base = "user"
+	}
+	for i := 1; i <= 100; i++ {
+		username := base
+		if i > 1 {
+			username = fmt.Sprintf("%s-%d", base, i)
+		}
+		user, err := us.insert(ctx, username, noPassword)
+		if errors.Is(err, ErrUsernameTaken) {
+			continue
+		}
+		return user, err
+	}
+	return nil, ErrUsernameTaken
+}
@@ -0,0 +1,254 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTTPublisher publishes the conditions of every refreshed location to an
+// MQTT broker, along with Home Assistant discovery configs so each location
+// shows up as a device with a sensor per metric.
+type MQTTPublisher struct {
+	Client mqtt.Client
+	Logger *slog.Logger
+	// TopicPrefix is where states are published, e.g. "personal-weather"
+	TopicPrefix string
+	// DiscoveryPrefix is Home Assistant's discovery prefix, "homeassistant" by default
+	DiscoveryPrefix string
+	// WeatherService looks up the alerts in effect for the state
+	WeatherService *WeatherService
+
+	mu         sync.Mutex
+	connected  bool
+	discovered map[int]bool
+	// generation changes on every reconnect, so discovery configs sent
+	// before it aren't counted as discovered
+	generation int
+}
+
+// MQTTOptions are how to reach the broker.
+type MQTTOptions struct {
+	Broker          string
+	Username        string
+	Password        string
+	ClientID        string
+	TopicPrefix     string
+	DiscoveryPrefix string
+}
+
+// NewMQTTPublisher connects to the broker. The client reconnects on its own
+// when the connection drops, Home Assistant is told the sensors are
+// unavailable while it's down.
+func NewMQTTPublisher(opts MQTTOptions, weatherService *WeatherService, logger *slog.Logger) (*MQTTPublisher, error) {
+	publisher := &MQTTPublisher{Logger: logger, TopicPrefix: opts.TopicPrefix, DiscoveryPrefix: opts.DiscoveryPrefix,
+		WeatherService: weatherService}
+	if publisher.TopicPrefix == "" {
+		publisher.TopicPrefix = "personal-weather"
+	}
+	if publisher.DiscoveryPrefix == "" {
+		publisher.DiscoveryPrefix = "homeassistant"
+	}
+	clientOpts := mqtt.NewClientOptions().
+		AddBroker(opts.Broker).
+		SetClientID(opts.ClientID).
+		SetUsername(opts.Username).
+		SetPassword(opts.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(publisher.availabilityTopic(), "offline", 1, true).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			logger.Info("Connected to MQTT broker", slog.String("broker", opts.Broker))
+			client.Publish(publisher.availabilityTopic(), 1, true, "online")
+			// after a reconnect the broker may have lost the retained configs,
+			// send them again
+			publisher.mu.Lock()
+			if publisher.connected {
+				publisher.discovered = nil
+				publisher.generation++
+			}
+			publisher.connected = true
+			publisher.mu.Unlock()
+		}).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			logger.Warn("Lost connection to MQTT broker", slog.String("broker", opts.Broker), slog.String("error", err.Error()))
+		})
+	if opts.ClientID == "" {
+		clientOpts.SetClientID("personal-weather")
+	}
+	publisher.Client = mqtt.NewClient(clientOpts)
+	// with connect retry on, this only fails for bad options, an unreachable
+	// broker is retried in the background
+	token := publisher.Client.Connect()
+	if token.WaitTimeout(5*time.Second) && token.Error() != nil {
+		return nil, fmt.Errorf("connecting to MQTT broker %s: %w", opts.Broker, token.Error())
+	}
+	return publisher, nil
+}
+
+// mqttState is the JSON published to a location's state topic, in the units
+// the metrics are stored in.
+type mqttState struct {
+	Temperature float64   `json:"temperature"`
+	FeelsLike   float64   `json:"feels_like"`
+	Humidity    float64   `json:"humidity"`
+	Pressure    float64   `json:"pressure"`
+	WindSpeed   float64   `json:"wind_speed"`
+	ObservedAt  time.Time `json:"observed_at"`
+	Alerts      []string  `json:"alerts"`
+}
+
+// Home Assistant device classes of the metrics
+var mqttDeviceClasses = map[string]string{
+	MetricTemperature: "temperature",
+	MetricFeelsLike:   "temperature",
+	MetricHumidity:    "humidity",
+	MetricPressure:    "atmospheric_pressure",
+	MetricWindSpeed:   "wind_speed",
+}
+
+// LocationRefreshed publishes the location's conditions and every alert in
+// effect for it, not only the new ones, since the state is retained and
+// replaces the last one.
+func (mp *MQTTPublisher) LocationRefreshed(ctx context.Context, location *Location, _ []Alert) {
+	if generation, discovered := mp.isDiscovered(location.ID); !discovered {
+		topics := make([]string, 0, len(Metrics))
+		tokens := make([]mqtt.Token, 0, len(Metrics))
+		for _, metric := range Metrics {
+			topic, payload, err := mp.discoveryConfig(location, metric)
+			if err != nil {
+				mp.Logger.Error("Failed to encode MQTT discovery config", slog.Int("location_id", location.ID), slog.String("error", err.Error()))
+				return
+			}
+			topics = append(topics, topic)
+			tokens = append(tokens, mp.Client.Publish(topic, 1, true, payload))
+		}
+		// the configs are sent again on the next refresh unless the broker
+		// took all of them
+		go func() {
+			for i, token := range tokens {
+				if err := mp.wait(topics[i], token); err != nil {
+					return
+				}
+			}
+			mp.markDiscovered(location.ID, generation)
+		}()
+	}
+	alerts, err := mp.WeatherService.GetLocationAlerts(ctx, location.ID)
+	if err != nil {
+		// publishing without them would tell Home Assistant they're over
+		mp.Logger.Error("Failed to get alerts for MQTT state", slog.Int("location_id", location.ID), slog.String("error", err.Error()))
+		return
+	}
+	state := mqttState{
+		Temperature: location.Temperature.Celsius(),
+		FeelsLike:   location.FeelsLike.Celsius(),
+		Humidity:    location.Humidity,
+		Pressure:    location.Pressure,
+		WindSpeed:   location.WindSpeed,
+		ObservedAt:  location.ObservedAt.UTC(),
+		Alerts:      make([]string, 0),
+	}
+	for _, alert := range alerts {
+		state.Alerts = append(state.Alerts, alert.Event)
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		mp.Logger.Error("Failed to encode MQTT state", slog.Int("location_id", location.ID), slog.String("error", err.Error()))
+		return
+	}
+	mp.publish(mp.stateTopic(location.ID), payload)
+}
+
+// LocationDeleted clears the location's retained configs and state, an empty
+// retained config makes Home Assistant remove the sensors.
+func (mp *MQTTPublisher) LocationDeleted(_ context.Context, locationID int) {
+	mp.mu.Lock()
+	delete(mp.discovered, locationID)
+	mp.mu.Unlock()
+	for _, metric := range Metrics {
+		mp.publish(mp.configTopic(locationID, metric), nil)
+	}
+	mp.publish(mp.stateTopic(locationID), nil)
+}
+
+// isDiscovered is whether the location's discovery configs were taken by the
+// broker since the last reconnect, along with the current connection.
+func (mp *MQTTPublisher) isDiscovered(locationID int) (generation int, discovered bool) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.generation, mp.discovered[locationID]
+}
+
+func (mp *MQTTPublisher) markDiscovered(locationID, generation int) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if generation != mp.generation {
+		return
+	}
+	if mp.discovered == nil {
+		mp.discovered = make(map[int]bool)
+	}
+	mp.discovered[locationID] = true
+}
+
+// discoveryConfig is the retained config that makes Home Assistant create a
+// sensor for the metric, grouped into one device per location.
+func (mp *MQTTPublisher) discoveryConfig(location *Location, metric string) (string, []byte, error) {
+	objectID := fmt.Sprintf("personal_weather_%d", location.ID)
+	config := map[string]any{
+		"name":                strings.ReplaceAll(metric, "_", " "),
+		"unique_id":           objectID + "_" + metric,
+		"state_topic":         mp.stateTopic(location.ID),
+		"value_template":      "{{ value_json." + metric + " }}",
+		"unit_of_measurement": metricUnits[metric],
+		"device_class":        mqttDeviceClasses[metric],
+		"state_class":         "measurement",
+		"availability_topic":  mp.availabilityTopic(),
+		"device": map[string]any{
+			"identifiers":  []string{objectID},
+			"name":         locationName(location) + " weather",
+			"manufacturer": "Personal Weather",
+		},
+	}
+	payload, err := json.Marshal(config)
+	return mp.configTopic(location.ID, metric), payload, err
+}
+
+func (mp *MQTTPublisher) configTopic(locationID int, metric string) string {
+	return fmt.Sprintf("%s/sensor/personal_weather_%d/%s/config", mp.DiscoveryPrefix, locationID, metric)
+}
+
+func (mp *MQTTPublisher) stateTopic(locationID int) string {
+	return fmt.Sprintf("%s/location/%d/state", mp.TopicPrefix, locationID)
+}
+
+func (mp *MQTTPublisher) availabilityTopic() string {
+	return mp.TopicPrefix + "/status"
+}
+
+// publish sends a retained message, so Home Assistant has the latest state
+// when it restarts, and logs the outcome in the background.
+func (mp *MQTTPublisher) publish(topic string, payload []byte) {
+	token := mp.Client.Publish(topic, 1, true, payload)
+	go mp.wait(topic, token)
+}
+
+// wait waits for the broker to take a message and logs when it didn't.
+func (mp *MQTTPublisher) wait(topic string, token mqtt.Token) error {
+	if !token.WaitTimeout(10 * time.Second) {
+		mp.Logger.Warn("MQTT publish timed out", slog.String("topic", topic))
+		return fmt.Errorf("publishing to %s timed out", topic)
+	}
+	if err := token.Error(); err != nil {
+		mp.Logger.Error("Failed to publish to MQTT", slog.String("topic", topic), slog.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
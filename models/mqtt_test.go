@@ -0,0 +1,233 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+
+	"github.com/daniel-z-johnson/personal-weather/units"
+)
+
+// testBroker is an MQTT broker running in the test, the address is for
+// MQTTOptions.Broker.
+func testBroker(t *testing.T) (*server.Server, string) {
+	t.Helper()
+	broker := server.New(&server.Options{Logger: testLogger()})
+	if err := broker.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	listener := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := broker.AddListener(listener); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return broker, "tcp://" + listener.Address()
+}
+
+// retained is the payload the broker keeps for topic, nil when there's none.
+func retained(broker *server.Server, topic string) []byte {
+	for _, pk := range broker.Topics.Messages(topic) {
+		return pk.Payload
+	}
+	return nil
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testLocation() *Location {
+	return &Location{
+		ID:          7,
+		City:        "Duluth",
+		State:       "MN",
+		Country:     "US",
+		Temperature: units.FromCelsius(-3),
+		FeelsLike:   units.FromCelsius(-8),
+		Humidity:    80,
+		Pressure:    1012,
+		WindSpeed:   4.5,
+		ObservedAt:  time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC),
+	}
+}
+
+// testWeatherService has testLocation saved, with its id, and the alerts.
+func testWeatherService(t *testing.T, alerts ...Alert) *WeatherService {
+	t.Helper()
+	ws := &WeatherService{DB: openTestDB(t), Logger: testLogger()}
+	location := testLocation()
+	_, err := ws.DB.Exec(`INSERT INTO locations (id, user_id, city, state, country, latitude, longitude) VALUES (?, 1, ?, ?, ?, 0, 0)`,
+		location.ID, location.City, location.State, location.Country)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ws.SaveAlerts(context.Background(), location.ID, alerts); err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	broker, addr := testBroker(t)
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	storm := Alert{Sender: "NWS Duluth", Event: "Winter Storm Warning", Start: start, End: start.Add(12 * time.Hour)}
+	windChill := Alert{Sender: "NWS Duluth", Event: "Wind Chill Advisory", Start: start, End: start.Add(6 * time.Hour)}
+	ended := Alert{Sender: "NWS Duluth", Event: "Dense Fog Advisory", Start: start, End: start.Add(time.Minute)}
+	ws := testWeatherService(t, storm, ended)
+	mp, err := NewMQTTPublisher(MQTTOptions{Broker: addr, ClientID: "test"}, ws, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Client.Disconnect(0)
+	eventually(t, "the connection", mp.Client.IsConnected)
+
+	// the storm was saved by an earlier refresh, only the wind chill is new
+	location := testLocation()
+	newAlerts, err := ws.SaveAlerts(context.Background(), location.ID, []Alert{storm, windChill})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp.LocationRefreshed(context.Background(), location, newAlerts)
+
+	stateTopic := "personal-weather/location/7/state"
+	eventually(t, "the state", func() bool { return retained(broker, stateTopic) != nil })
+	var state mqttState
+	if err := json.Unmarshal(retained(broker, stateTopic), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Temperature != -3 || state.Humidity != 80 || fmt.Sprint(state.Alerts) != "[Wind Chill Advisory Winter Storm Warning]" {
+		t.Errorf("state = %+v", state)
+	}
+	for _, metric := range Metrics {
+		topic := "homeassistant/sensor/personal_weather_7/" + metric + "/config"
+		eventually(t, topic, func() bool { return retained(broker, topic) != nil })
+		var config map[string]any
+		if err := json.Unmarshal(retained(broker, topic), &config); err != nil {
+			t.Fatal(err)
+		}
+		if config["state_topic"] != stateTopic || config["unique_id"] != "personal_weather_7_"+metric {
+			t.Errorf("%s config = %v", metric, config)
+		}
+	}
+	eventually(t, "the location to be discovered", func() bool {
+		_, discovered := mp.isDiscovered(location.ID)
+		return discovered
+	})
+	if string(retained(broker, "personal-weather/status")) != "online" {
+		t.Errorf("status = %q, want online", retained(broker, "personal-weather/status"))
+	}
+
+	mp.LocationDeleted(context.Background(), location.ID)
+	for _, metric := range Metrics {
+		topic := "homeassistant/sensor/personal_weather_7/" + metric + "/config"
+		eventually(t, topic+" to be cleared", func() bool { return retained(broker, topic) == nil })
+	}
+	eventually(t, "the state to be cleared", func() bool { return retained(broker, stateTopic) == nil })
+	if _, discovered := mp.isDiscovered(location.ID); discovered {
+		t.Error("a deleted location is still discovered")
+	}
+}
+
+// failingClient is an mqtt.Client that fails the first failures publishes.
+type failingClient struct {
+	mqtt.Client
+
+	mu        sync.Mutex
+	failures  int
+	published []string
+}
+
+func (fc *failingClient) Publish(topic string, _ byte, _ bool, _ any) mqtt.Token {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.published = append(fc.published, topic)
+	if fc.failures > 0 {
+		fc.failures--
+		return doneToken{err: errors.New("not connected")}
+	}
+	return doneToken{}
+}
+
+func (fc *failingClient) count(topic string) int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	n := 0
+	for _, published := range fc.published {
+		if published == topic {
+			n++
+		}
+	}
+	return n
+}
+
+type doneToken struct{ err error }
+
+func (dt doneToken) Wait() bool                     { return true }
+func (dt doneToken) WaitTimeout(time.Duration) bool { return true }
+func (dt doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (dt doneToken) Error() error { return dt.err }
+
+func TestMQTTDiscoveryRetried(t *testing.T) {
+	client := &failingClient{failures: 1}
+	mp := &MQTTPublisher{Client: client, Logger: testLogger(), TopicPrefix: "personal-weather", DiscoveryPrefix: "homeassistant",
+		WeatherService: testWeatherService(t)}
+	location := testLocation()
+	topic := mp.configTopic(location.ID, Metrics[0])
+
+	mp.LocationRefreshed(context.Background(), location, nil)
+	// give the check of the publish a moment, it must not mark the location
+	time.Sleep(50 * time.Millisecond)
+	if _, discovered := mp.isDiscovered(location.ID); discovered {
+		t.Fatal("location discovered though its config wasn't published")
+	}
+
+	mp.LocationRefreshed(context.Background(), location, nil)
+	if n := client.count(topic); n != 2 {
+		t.Errorf("config published %d times, want 2", n)
+	}
+	eventually(t, "the location to be discovered", func() bool {
+		_, discovered := mp.isDiscovered(location.ID)
+		return discovered
+	})
+
+	mp.LocationRefreshed(context.Background(), location, nil)
+	if n := client.count(topic); n != 2 {
+		t.Errorf("config published %d times after discovery, want 2", n)
+	}
+}
+
+func TestMQTTDiscoveryAfterReconnect(t *testing.T) {
+	mp := &MQTTPublisher{Client: &failingClient{}, Logger: testLogger()}
+	generation, _ := mp.isDiscovered(7)
+	// a reconnect while the configs were on their way
+	mp.mu.Lock()
+	mp.generation++
+	mp.mu.Unlock()
+	mp.markDiscovered(7, generation)
+	if _, discovered := mp.isDiscovered(7); discovered {
+		t.Error("configs sent before a reconnect counted as discovered")
+	}
+}
@@ -0,0 +1,330 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notification is a message for a person, e.g. "Cabin is below freezing".
+type Notification struct {
+	Title    string    `json:"title"`
+	Message  string    `json:"message"`
+	Location string    `json:"location,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// NotificationSink delivers notifications somewhere people will see them.
+type NotificationSink interface {
+	Name() string
+	Send(ctx context.Context, n Notification) error
+}
+
+// smtpTimeout bounds an email when the context has no deadline of its own
+const smtpTimeout = 30 * time.Second
+
+// SMTPSink emails notifications. It upgrades to STARTTLS when the server
+// offers it, servers that only speak implicit TLS (port 465) won't work.
+type SMTPSink struct {
+	SinkName string
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+func (s *SMTPSink) Name() string {
+	return s.SinkName
+}
+
+func (s *SMTPSink) Send(ctx context.Context, n Notification) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.To, ", "))
+	// a line break in a title would start a header of its own
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(n.Title)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(n.Message, "\n", "\r\n"))
+	msg.WriteString("\r\n")
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	if err := s.sendMail(ctx, addr, msg.Bytes()); err != nil {
+		if ctx.Err() != nil {
+			// the connection's error is only a timeout
+			err = ctx.Err()
+		}
+		return fmt.Errorf("sending email through %s: %w", addr, err)
+	}
+	return nil
+}
+
+// sendMail is smtp.SendMail over a connection that gives up when ctx is
+// done or after smtpTimeout, so a hung server can't hold on to it.
+func (s *SMTPSink) sendMail(ctx context.Context, addr string, msg []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, ok := ctx.Deadline(); !ok {
+		conn.SetDeadline(time.Now().Add(smtpTimeout))
+	}
+	// cutting the connection only once ctx is done means Send sees ctx.Err()
+	stop := context.AfterFunc(ctx, func() {
+		// unblocks whatever is reading or writing
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(s.From); err != nil {
+		return err
+	}
+	for _, to := range s.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// WebhookSink POSTs the notification as JSON to a URL.
+type WebhookSink struct {
+	SinkName string
+	URL      string
+	Headers  map[string]string
+}
+
+func (s *WebhookSink) Name() string {
+	return s.SinkName
+}
+
+func (s *WebhookSink) Send(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range s.Headers {
+		req.Header.Set(key, value)
+	}
+	return sendNotificationRequest(req)
+}
+
+const (
+	PushNtfy   = "ntfy"
+	PushGotify = "gotify"
+)
+
+// PushSink sends phone push notifications through a ntfy topic URL
+// (https://ntfy.sh/my-topic) or a Gotify server URL.
+type PushSink struct {
+	SinkName string
+	Kind     string
+	URL      string
+	// Token is a ntfy access token or a Gotify application token
+	Token    string
+	Priority int
+}
+
+func (s *PushSink) Name() string {
+	return s.SinkName
+}
+
+func (s *PushSink) Send(ctx context.Context, n Notification) error {
+	var req *http.Request
+	var err error
+	switch s.Kind {
+	case PushNtfy:
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, s.URL, strings.NewReader(n.Message))
+		if err != nil {
+			return err
+		}
+		// headers are ASCII, ntfy decodes RFC 2047 encoded words for the "°"s
+		req.Header.Set("Title", mime.QEncoding.Encode("utf-8", n.Title))
+		if s.Priority > 0 {
+			req.Header.Set("Priority", strconv.Itoa(s.Priority))
+		}
+		if s.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.Token)
+		}
+	case PushGotify:
+		body, err := json.Marshal(map[string]any{"title": n.Title, "message": n.Message, "priority": s.Priority})
+		if err != nil {
+			return err
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(s.URL, "/")+"/message", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Gotify-Key", s.Token)
+	default:
+		return fmt.Errorf("unknown push service %q", s.Kind)
+	}
+	return sendNotificationRequest(req)
+}
+
+// deliveryClient sends notifications and webhooks, receivers get longer than
+// the weather API to answer
+var deliveryClient = &http.Client{Timeout: 10 * time.Second}
+
+func sendNotificationRequest(req *http.Request) error {
+	resp, err := deliveryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with status %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// Notifier checks the rules after every refresh and sends what they produce
+// to their sinks.
+type Notifier struct {
+	Logger    *slog.Logger
+	Sinks     map[string]NotificationSink
+	Rules     []NotificationRule
+	Evaluator *RuleEvaluator
+}
+
+func (n *Notifier) LocationRefreshed(ctx context.Context, location *Location, newAlerts []Alert) {
+	now := time.Now()
+	name := locationName(location)
+	for _, rule := range n.Rules {
+		if !rule.matchesLocation(location) {
+			continue
+		}
+		switch rule.Kind {
+		case RuleThreshold:
+			notify, err := n.Evaluator.Evaluate(ctx, rule, location, now)
+			if err != nil {
+				n.Logger.Error("Failed to evaluate rule", slog.String("rule", rule.Name), slog.Any("error", err))
+				continue
+			}
+			if !notify {
+				continue
+			}
+			value, _ := MetricValue(location, rule.Condition.Metric)
+			n.send(ctx, rule, location, Notification{
+				Title:    fmt.Sprintf("%s: %s", name, rule.Name),
+				Message:  fmt.Sprintf("%s is %s in %s, the rule is %s.", strings.ReplaceAll(rule.Condition.Metric, "_", " "), formatMetric(rule.Condition.Metric, value), name, rule.Condition),
+				Location: name,
+				Time:     now,
+			})
+		case RuleAlert:
+			if rule.QuietHours.Contains(now) {
+				// the alerts stay unnotified, the first refresh after quiet
+				// hours sends the ones still in effect
+				n.Logger.Info("Alert notifications held back during quiet hours", slog.String("rule", rule.Name),
+					slog.Int("location_id", location.ID), slog.Int("new_alerts", len(newAlerts)))
+				continue
+			}
+			alerts, err := n.Evaluator.AlertsToNotify(ctx, rule, location, now)
+			if err != nil {
+				n.Logger.Error("Failed to get alerts to notify", slog.String("rule", rule.Name), slog.Any("error", err))
+				continue
+			}
+			for _, alert := range alerts {
+				// each alert gets its own notification, once however many users
+				// saved the place
+				n.send(ctx, rule, location, Notification{
+					Title:    fmt.Sprintf("%s: %s", name, alert.Event),
+					Message:  fmt.Sprintf("%s until %s\n\n%s", alert.Event, alert.End.Format(time.RFC1123), alert.Description),
+					Location: name,
+					Time:     now,
+				})
+			}
+		}
+	}
+}
+
+// SendTest sends a test notification to one sink and reports how it went.
+func (n *Notifier) SendTest(ctx context.Context, sinkName string) error {
+	sink, ok := n.Sinks[sinkName]
+	if !ok {
+		return fmt.Errorf("no notification sink named %q", sinkName)
+	}
+	err := sink.Send(ctx, Notification{
+		Title:   "Personal Weather test notification",
+		Message: "If you can read this, notifications to " + sinkName + " work.",
+		Time:    time.Now(),
+	})
+	if err != nil {
+		n.Logger.Error("Failed to send test notification", slog.String("sink", sinkName), slog.Any("error", err))
+		return err
+	}
+	n.Logger.Info("Test notification sent", slog.String("sink", sinkName))
+	return nil
+}
+
+// send delivers in the background so a slow mail server doesn't hold up a
+// page load.
+func (n *Notifier) send(ctx context.Context, rule NotificationRule, location *Location, notification Notification) {
+	for _, sinkName := range rule.Sinks {
+		sink, ok := n.Sinks[sinkName]
+		if !ok {
+			n.Logger.Error("Notification rule uses an unknown sink", slog.String("rule", rule.Name), slog.String("sink", sinkName))
+			continue
+		}
+		go func() {
+			if err := sink.Send(ctx, notification); err != nil {
+				n.Logger.Error("Failed to send notification", slog.String("rule", rule.Name),
+					slog.String("sink", sinkName), slog.Any("error", err))
+				return
+			}
+			n.Logger.Info("Notification sent", slog.String("rule", rule.Name), slog.String("sink", sinkName),
+				slog.Int("location_id", location.ID))
+		}()
+	}
+}
+
+func locationName(location *Location) string {
+	if location.State != "" {
+		return location.City + ", " + location.State
+	}
+	return location.City
+}
@@ -0,0 +1,261 @@
+package models
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpServer is a stand-in mail server that keeps what it's sent. A hung
+// server accepts connections and never says anything.
+type smtpServer struct {
+	listener net.Listener
+	hung     bool
+
+	mu         sync.Mutex
+	recipients []string
+	messages   []string
+}
+
+func startSMTPServer(t *testing.T, hung bool) *smtpServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &smtpServer{listener: listener, hung: hung}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	if s.hung {
+		// the test ends by closing the listener, reading waits until the
+		// client gives up
+		conn.Read(make([]byte, 1))
+		return
+	}
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250-localhost")
+			reply("250 8BITMIME")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			s.mu.Lock()
+			s.recipients = append(s.recipients, strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>"))
+			s.mu.Unlock()
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 go ahead")
+			var msg strings.Builder
+			for {
+				dataLine, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				msg.WriteString(dataLine)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, msg.String())
+			s.mu.Unlock()
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (s *smtpServer) sink() *SMTPSink {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	return &SMTPSink{SinkName: "email", Host: host, Port: portNumber, From: "weather@example.com",
+		To: []string{"dan@example.com", "bob@example.com"}}
+}
+
+func TestSMTPSink(t *testing.T) {
+	server := startSMTPServer(t, false)
+	err := server.sink().Send(context.Background(), Notification{
+		Title:   "Cabin: Frost\r\nBcc: mallory@example.com",
+		Message: "It's -3 °C\nat the cabin.",
+		Time:    time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if strings.Join(server.recipients, ",") != "dan@example.com,bob@example.com" {
+		t.Errorf("recipients = %v", server.recipients)
+	}
+	if len(server.messages) != 1 {
+		t.Fatalf("server got %d messages, want 1", len(server.messages))
+	}
+	msg := server.messages[0]
+	headers, body, _ := strings.Cut(msg, "\r\n\r\n")
+	for _, header := range strings.Split(headers, "\r\n") {
+		if strings.HasPrefix(header, "Bcc:") {
+			t.Errorf("the title injected a header: %q", header)
+		}
+	}
+	if !strings.Contains(headers, "Subject: Cabin: Frost  Bcc: mallory@example.com\r\n") {
+		t.Errorf("headers = %q, want the title on one Subject line", headers)
+	}
+	if body != "It's -3 °C\r\nat the cabin.\r\n" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestSMTPSinkEncodesSubject(t *testing.T) {
+	server := startSMTPServer(t, false)
+	if err := server.sink().Send(context.Background(), Notification{Title: "Cabin: −3 °C", Time: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !strings.Contains(server.messages[0], "Subject: =?utf-8?q?") {
+		t.Errorf("message = %q, want a Q encoded Subject", server.messages[0])
+	}
+}
+
+func TestSMTPSinkHungServer(t *testing.T) {
+	server := startSMTPServer(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := server.sink().Send(ctx, Notification{Title: "Frost", Time: time.Now()})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Send error = %v, want context.DeadlineExceeded", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("Send took %s with a 100ms deadline", took)
+	}
+}
+
+// recordingServer keeps the last request it got and its body.
+func recordingServer(t *testing.T) (*httptest.Server, func() (*http.Request, string)) {
+	t.Helper()
+	var mu sync.Mutex
+	var last *http.Request
+	var lastBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body strings.Builder
+		bufio.NewReader(r.Body).WriteTo(&body)
+		mu.Lock()
+		last, lastBody = r, body.String()
+		mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+	return server, func() (*http.Request, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		return last, lastBody
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	server, last := recordingServer(t)
+	sink := &WebhookSink{SinkName: "hook", URL: server.URL + "/notify", Headers: map[string]string{"Authorization": "Bearer secret"}}
+	sent := Notification{Title: "Cabin: Frost", Message: "It's -3 °C", Location: "Cabin", Time: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)}
+	if err := sink.Send(context.Background(), sent); err != nil {
+		t.Fatal(err)
+	}
+	req, body := last()
+	if req.Method != http.MethodPost || req.URL.Path != "/notify" {
+		t.Errorf("got %s %s, want POST /notify", req.Method, req.URL.Path)
+	}
+	if req.Header.Get("Content-Type") != "application/json" || req.Header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("headers = %v", req.Header)
+	}
+	var got Notification
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != sent.Title || got.Message != sent.Message || got.Location != sent.Location || !got.Time.Equal(sent.Time) {
+		t.Errorf("got %+v, want %+v", got, sent)
+	}
+}
+
+func TestWebhookSinkError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	sink := &WebhookSink{SinkName: "hook", URL: server.URL}
+	if err := sink.Send(context.Background(), Notification{Title: "Frost"}); err == nil {
+		t.Error("Send succeeded against a 502")
+	}
+}
+
+func TestPushSinkNtfy(t *testing.T) {
+	server, last := recordingServer(t)
+	sink := &PushSink{SinkName: "phone", Kind: PushNtfy, URL: server.URL + "/cabin", Token: "tk_secret", Priority: 4}
+	if err := sink.Send(context.Background(), Notification{Title: "Cabin: −3 °C", Message: "Frost tonight"}); err != nil {
+		t.Fatal(err)
+	}
+	req, body := last()
+	if req.URL.Path != "/cabin" || body != "Frost tonight" {
+		t.Errorf("got %s with body %q", req.URL.Path, body)
+	}
+	if req.Header.Get("Title") != "=?utf-8?q?Cabin:_=E2=88=923_=C2=B0C?=" {
+		t.Errorf("Title header = %q", req.Header.Get("Title"))
+	}
+	if req.Header.Get("Priority") != "4" || req.Header.Get("Authorization") != "Bearer tk_secret" {
+		t.Errorf("headers = %v", req.Header)
+	}
+}
+
+func TestPushSinkGotify(t *testing.T) {
+	server, last := recordingServer(t)
+	sink := &PushSink{SinkName: "phone", Kind: PushGotify, URL: server.URL + "/", Token: "app-token", Priority: 5}
+	if err := sink.Send(context.Background(), Notification{Title: "Cabin: Frost", Message: "Frost tonight"}); err != nil {
+		t.Fatal(err)
+	}
+	req, body := last()
+	if req.URL.Path != "/message" || req.Header.Get("X-Gotify-Key") != "app-token" {
+		t.Errorf("got %s with headers %v", req.URL.Path, req.Header)
+	}
+	var got struct {
+		Title    string `json:"title"`
+		Message  string `json:"message"`
+		Priority int    `json:"priority"`
+	}
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Cabin: Frost" || got.Message != "Frost tonight" || got.Priority != 5 {
+		t.Errorf("got %+v", got)
+	}
+}
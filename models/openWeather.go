@@ -1,21 +1,95 @@
 package models
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
+
+	"github.com/daniel-z-johnson/personal-weather/units"
 )
 
 const baseGeoLocatorURL = "http://api.openweathermap.org/geo/1.0/direct"
+const baseReverseGeoURL = "http://api.openweathermap.org/geo/1.0/reverse"
+const baseZipGeoURL = "http://api.openweathermap.org/geo/1.0/zip"
 const baseTemperatureURL = "https://api.openweathermap.org/data/3.0/onecall"
 
 type OpenWeatherAPI struct {
 	APIKey string
 	Logger *slog.Logger
+	// Client makes the requests, defaults to one that doesn't retry
+	Client *ProviderClient
+}
+
+var defaultClient = &ProviderClient{Name: ProviderOpenWeatherMap}
+
+// ErrOneCallNotSubscribed is returned when the API key works but isn't
+// subscribed to One Call 3.0, which the conditions come from
+var ErrOneCallNotSubscribed = fmt.Errorf("API key isn't subscribed to One Call 3.0: %w", ErrProviderUnauthorized)
+
+// get sends a GET that's abandoned when ctx is cancelled. Failures, including
+// responses other than 200 OK, are returned as a *ProviderError.
+func (ows *OpenWeatherAPI) get(ctx context.Context, uri string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := ows.Client
+	if client == nil {
+		client = defaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, &ProviderError{Provider: ProviderOpenWeatherMap, Kind: ErrProviderUnavailable, Err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, statusError(req.URL.Path, resp)
+	}
+	return resp, nil
+}
+
+// statusError reads the message the API explains errors with, e.g.
+// {"cod": 401, "message": "Invalid API key. Please see ..."}.
+func statusError(path string, resp *http.Response) error {
+	var body struct {
+		Message string `json:"message"`
+	}
+	// the message is a bonus, the status says enough without it
+	json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body)
+	providerErr := &ProviderError{Provider: ProviderOpenWeatherMap, StatusCode: resp.StatusCode, Message: body.Message}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		providerErr.Kind = ErrProviderUnauthorized
+		// keys work for geocoding without the One Call subscription
+		if strings.HasPrefix(path, "/data/3.0/onecall") && !strings.Contains(body.Message, "Invalid API key") {
+			providerErr.Kind = ErrOneCallNotSubscribed
+		}
+	case resp.StatusCode == http.StatusTooManyRequests:
+		providerErr.Kind = ErrProviderQuota
+	case resp.StatusCode == http.StatusNotFound:
+		providerErr.Kind = ErrProviderNotFound
+	case resp.StatusCode >= 500:
+		providerErr.Kind = ErrProviderUnavailable
+	}
+	return providerErr
+}
+
+// decode reads the JSON body of a successful response into v.
+func decode(resp *http.Response, v any) error {
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return &ProviderError{Provider: ProviderOpenWeatherMap, Kind: ErrProviderDecode, StatusCode: resp.StatusCode, Err: err}
+	}
+	return nil
 }
 
 type GeoLocation struct {
@@ -32,12 +106,38 @@ type TemperatureData struct {
 	Latitude  float64 `json:"lat"`
 	Longitude float64 `json:"lon"`
 	Current   struct {
-		Temp float64 `json:"temp"`
+		Time      int64   `json:"dt"`
+		Temp      float64 `json:"temp"`
+		FeelsLike float64 `json:"feels_like"`
+		Pressure  float64 `json:"pressure"`
+		Humidity  float64 `json:"humidity"`
+		WindSpeed float64 `json:"wind_speed"`
 	}
+	Alerts []struct {
+		SenderName  string `json:"sender_name"`
+		Event       string `json:"event"`
+		Start       int64  `json:"start"`
+		End         int64  `json:"end"`
+		Description string `json:"description"`
+	} `json:"alerts"`
 }
 
-func (ows *OpenWeatherAPI) GetCityCoordinates(city, state, country string) ([]GeoLocation, error) {
-	client := &http.Client{Timeout: 5 * time.Second}
+// Conditions are the current weather at a location.
+type Conditions struct {
+	Temperature units.Temperature
+	FeelsLike   units.Temperature
+	// Humidity is relative humidity in percent
+	Humidity float64
+	// Pressure is in hPa
+	Pressure float64
+	// WindSpeed is in m/s
+	WindSpeed float64
+	Observed  time.Time
+	// Alerts are the severe weather alerts in effect
+	Alerts []Alert
+}
+
+func (ows *OpenWeatherAPI) GetCityCoordinates(ctx context.Context, city, state, country string) ([]GeoLocation, error) {
 	city = strings.TrimSpace(city)
 	state = strings.TrimSpace(state)
 	country = strings.TrimSpace(country)
@@ -63,19 +163,89 @@ func (ows *OpenWeatherAPI) GetCityCoordinates(city, state, country string) ([]Ge
 	values.Set("limit", "5")
 	values.Set("appid", ows.APIKey)
 	uri.RawQuery = values.Encode()
-	resp, err := client.Get(uri.String())
+	resp, err := ows.get(ctx, uri.String())
 	if err != nil {
 		ows.Logger.Error("Request failed", slog.String("error", err.Error()))
 		return nil, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		ows.Logger.Error("Did not get a 200 OK response from FindCities API",
-			slog.String("status", resp.Status))
-		return nil, fmt.Errorf("status code %d Error: %w", resp.StatusCode, err)
+	locations := make([]GeoLocation, 0)
+	err = decode(resp, &locations)
+	if err != nil {
+		ows.Logger.Error("failed to decode response body", slog.String("error", err.Error()))
+		return nil, err
+	}
+	return locations, nil
+}
+
+// GetZipCoordinates looks up a postal code, the API answers with a single place.
+// Country is an ISO 3166 code, the API assumes US when it's empty.
+func (ows *OpenWeatherAPI) GetZipCoordinates(ctx context.Context, zip, country string) ([]GeoLocation, error) {
+	zip = strings.TrimSpace(zip)
+	country = strings.TrimSpace(country)
+	if zip == "" {
+		ows.Logger.Error("Postal code cannot be empty")
+		return nil, fmt.Errorf("postal code cannot be empty")
+	}
+	zipValue := zip
+	if country != "" {
+		zipValue += "," + country
+	}
+	uri, err := url.Parse(baseZipGeoURL)
+	if err != nil {
+		ows.Logger.Error("Failed to parse GetZipCoordinates API URL",
+			slog.String("url", baseZipGeoURL), slog.Any("error", err))
+		return nil, fmt.Errorf("failed to parse GetZipCoordinates API URL: %w", err)
+	}
+	values := uri.Query()
+	values.Set("zip", zipValue)
+	values.Set("appid", ows.APIKey)
+	uri.RawQuery = values.Encode()
+	resp, err := ows.get(ctx, uri.String())
+	if errors.Is(err, ErrProviderNotFound) {
+		// unknown postal codes are a 404, treat that as no results
+		return make([]GeoLocation, 0), nil
+	}
+	if err != nil {
+		ows.Logger.Error("Request failed", slog.String("error", err.Error()))
+		return nil, err
 	}
+	defer resp.Body.Close()
+	var location GeoLocation
+	err = decode(resp, &location)
+	if err != nil {
+		ows.Logger.Error("failed to decode response body", slog.String("error", err.Error()))
+		return nil, err
+	}
+	return []GeoLocation{location}, nil
+}
+
+// ReverseGeocode looks up the names of places near the given coordinates.
+func (ows *OpenWeatherAPI) ReverseGeocode(ctx context.Context, lat, lon float64) ([]GeoLocation, error) {
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		ows.Logger.Error("Coordinates out of range", slog.Float64("latitude", lat), slog.Float64("longitude", lon))
+		return nil, fmt.Errorf("coordinates out of range")
+	}
+	uri, err := url.Parse(baseReverseGeoURL)
+	if err != nil {
+		ows.Logger.Error("Failed to parse ReverseGeocode API URL",
+			slog.String("url", baseReverseGeoURL), slog.Any("error", err))
+		return nil, fmt.Errorf("failed to parse ReverseGeocode API URL: %w", err)
+	}
+	values := uri.Query()
+	values.Set("lat", fmt.Sprintf("%f", lat))
+	values.Set("lon", fmt.Sprintf("%f", lon))
+	values.Set("limit", "5")
+	values.Set("appid", ows.APIKey)
+	uri.RawQuery = values.Encode()
+	resp, err := ows.get(ctx, uri.String())
+	if err != nil {
+		ows.Logger.Error("Request failed", slog.String("error", err.Error()))
+		return nil, err
+	}
+	defer resp.Body.Close()
 	locations := make([]GeoLocation, 0)
-	err = json.NewDecoder(resp.Body).Decode(&locations)
+	err = decode(resp, &locations)
 	if err != nil {
 		ows.Logger.Error("failed to decode response body", slog.String("error", err.Error()))
 		return nil, err
@@ -83,37 +253,51 @@ func (ows *OpenWeatherAPI) GetCityCoordinates(city, state, country string) ([]Ge
 	return locations, nil
 }
 
-func (ows *OpenWeatherAPI) GetTemperature(lat, lon float64) (float64, error) {
-	client := &http.Client{Timeout: 5 * time.Second}
+// GetConditions fetches the current conditions at the coordinates. The API is
+// asked for metric values so wind speed is m/s and pressure hPa.
+func (ows *OpenWeatherAPI) GetConditions(ctx context.Context, lat, lon float64) (*Conditions, error) {
 	uri, err := url.Parse(baseTemperatureURL)
 	if err != nil {
-		ows.Logger.Error("Failed to parse GetTemperature API URL",
+		ows.Logger.Error("Failed to parse GetConditions API URL",
 			slog.String("url", baseTemperatureURL), slog.Any("error", err))
-		return 0, fmt.Errorf("failed to parse GetTemperature API URL: %w", err)
+		return nil, fmt.Errorf("failed to parse GetConditions API URL: %w", err)
 	}
 	values := uri.Query()
 	values.Set("lat", fmt.Sprintf("%f", lat))
 	values.Set("lon", fmt.Sprintf("%f", lon))
 	values.Set("appid", ows.APIKey)
-	values.Set("units", "imperial")
-	values.Set("exclude", "minutely,hourly,daily,alerts")
+	values.Set("units", "metric")
+	values.Set("exclude", "minutely,hourly,daily")
 	uri.RawQuery = values.Encode()
-	resp, err := client.Get(uri.String())
+	resp, err := ows.get(ctx, uri.String())
 	if err != nil {
 		ows.Logger.Error("Request failed", slog.String("error", err.Error()))
-		return 0, err
+		return nil, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		ows.Logger.Error("Did not get a 200 OK response from GetTemperature API",
-			slog.String("status", resp.Status))
-		return 0, fmt.Errorf("status code %d Error: %w", resp.StatusCode, err)
-	}
 	var tempData TemperatureData
-	err = json.NewDecoder(resp.Body).Decode(&tempData)
+	err = decode(resp, &tempData)
 	if err != nil {
 		ows.Logger.Error("failed to decode response body", slog.String("error", err.Error()))
-		return 0, err
+		return nil, err
+	}
+	alerts := make([]Alert, 0, len(tempData.Alerts))
+	for _, alert := range tempData.Alerts {
+		alerts = append(alerts, Alert{
+			Sender:      alert.SenderName,
+			Event:       alert.Event,
+			Start:       time.Unix(alert.Start, 0),
+			End:         time.Unix(alert.End, 0),
+			Description: alert.Description,
+		})
 	}
-	return tempData.Current.Temp, nil
+	return &Conditions{
+		Temperature: units.FromCelsius(tempData.Current.Temp),
+		FeelsLike:   units.FromCelsius(tempData.Current.FeelsLike),
+		Humidity:    tempData.Current.Humidity,
+		Pressure:    tempData.Current.Pressure,
+		WindSpeed:   tempData.Current.WindSpeed,
+		Observed:    time.Unix(tempData.Current.Time, 0),
+		Alerts:      alerts,
+	}, nil
 }
@@ -0,0 +1,114 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// redirectTransport sends every request to a test server, whatever the URL.
+type redirectTransport struct {
+	to *url.URL
+}
+
+func (rt redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = rt.to.Scheme
+	req.URL.Host = rt.to.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// testWeatherAPI is an OpenWeatherAPI that calls server instead of OpenWeatherMap.
+func testWeatherAPI(t *testing.T, server *httptest.Server, client *ProviderClient) *OpenWeatherAPI {
+	t.Helper()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client == nil {
+		client = &ProviderClient{}
+	}
+	client.Name = ProviderOpenWeatherMap
+	client.Logger = testLogger()
+	client.Transport = redirectTransport{to: u}
+	return &OpenWeatherAPI{APIKey: "test", Logger: testLogger(), Client: client}
+}
+
+// blockingServer answers only once the client gives up or the test ends.
+func blockingServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	t.Cleanup(func() {
+		close(done)
+		server.Close()
+	})
+	return server
+}
+
+func TestGetConditionsDeadline(t *testing.T) {
+	api := testWeatherAPI(t, blockingServer(t), &ProviderClient{Timeout: time.Minute})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := api.GetConditions(ctx, 48.1, 11.5)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GetConditions error = %v, want context.DeadlineExceeded", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("GetConditions took %s after the deadline", took)
+	}
+}
+
+func TestGetCityCoordinatesCanceled(t *testing.T) {
+	api := testWeatherAPI(t, blockingServer(t), &ProviderClient{Timeout: time.Minute})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := api.GetCityCoordinates(ctx, "Munich", "", "DE")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetCityCoordinates error = %v, want context.Canceled", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("GetCityCoordinates took %s after being canceled", took)
+	}
+}
+
+func TestCanceledCallIsNotRetried(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	api := testWeatherAPI(t, server, &ProviderClient{Retries: 5, Backoff: time.Minute, MaxBackoff: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := api.GetConditions(ctx, 48.1, 11.5)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetConditions error = %v, want context.Canceled", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("GetConditions waited %s to retry after being canceled", took)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("server got %d calls, want 1", n)
+	}
+}
@@ -0,0 +1,249 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned while calls to a provider are paused after too
+// many failures in a row
+var ErrCircuitOpen = errors.New("the provider is failing, calls to it are paused")
+
+// providerTransport is shared by every provider so connections are reused
+var providerTransport = &http.Transport{
+	Proxy:               http.ProxyFromEnvironment,
+	ForceAttemptHTTP2:   true,
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 10,
+	IdleConnTimeout:     90 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+}
+
+type retryHookKey struct{}
+
+// withRetryHook has ProviderClient call hook before each retry of the
+// requests made with the returned context, the retries stop when it fails.
+func withRetryHook(ctx context.Context, hook func(context.Context) error) context.Context {
+	return context.WithValue(ctx, retryHookKey{}, hook)
+}
+
+// ProviderClient calls a provider's API. GETs that fail with a network error,
+// a 429 or a 5xx are retried with exponential backoff and jitter, waiting
+// for the Retry-After the provider asks for. After BreakerFailures failed
+// calls in a row the calls are paused for BreakerCooldown, then a single
+// call checks whether the provider is back.
+type ProviderClient struct {
+	// Name is the provider in the logs, e.g. "openweathermap"
+	Name   string
+	Logger *slog.Logger
+	// Timeout is per attempt, defaults to 5 seconds
+	Timeout time.Duration
+	// Retries is how many times a failed call is tried again
+	Retries int
+	// Backoff is the wait before the first retry, defaults to 500ms
+	Backoff time.Duration
+	// MaxBackoff caps the wait, defaults to 10 seconds. A longer Retry-After
+	// isn't waited for, the calls are paused until then instead.
+	MaxBackoff time.Duration
+	// BreakerFailures is how many failed calls in a row pause the calls, 0
+	// never pauses them
+	BreakerFailures int
+	// BreakerCooldown is how long the calls are paused, defaults to a minute
+	BreakerCooldown time.Duration
+	// Transport sends the requests, defaults to one shared by every provider
+	Transport http.RoundTripper
+
+	once   sync.Once
+	client *http.Client
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// Do sends req, retrying it when it's a GET. Responses with an error status
+// are returned like http.Client returns them once the retries are used up.
+func (pc *ProviderClient) Do(req *http.Request) (*http.Response, error) {
+	pc.once.Do(func() {
+		timeout := pc.Timeout
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		transport := pc.Transport
+		if transport == nil {
+			transport = providerTransport
+		}
+		pc.client = &http.Client{Transport: transport, Timeout: timeout}
+	})
+	probe, err := pc.allow()
+	if err != nil {
+		return nil, err
+	}
+	retries := pc.Retries
+	if req.Method != http.MethodGet {
+		// only GETs are safe to send twice
+		retries = 0
+	}
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, err := pc.client.Do(req)
+		if ctx.Err() != nil {
+			// the caller gave up, that says nothing about the provider
+			pc.release(probe)
+			return resp, err
+		}
+		if err == nil && !retryable(resp.StatusCode) {
+			pc.finish(probe, true, 0)
+			return resp, nil
+		}
+		status := 0
+		wait := pc.backoff(attempt)
+		var retryAfter time.Duration
+		if err == nil {
+			status = resp.StatusCode
+			if retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); retryAfter > wait {
+				wait = retryAfter
+			}
+		}
+		if attempt >= retries || wait > pc.maxBackoff() {
+			pc.finish(probe, false, retryAfter)
+			return resp, err
+		}
+		if hook, ok := ctx.Value(retryHookKey{}).(func(context.Context) error); ok {
+			if hookErr := hook(ctx); hookErr != nil {
+				pc.logger().Warn("Not retrying provider call", slog.String("provider", pc.Name),
+					slog.Int("status", status), slog.Any("error", err), slog.String("reason", hookErr.Error()))
+				pc.finish(probe, false, retryAfter)
+				return resp, err
+			}
+		}
+		pc.logger().Warn("Retrying provider call", slog.String("provider", pc.Name), slog.String("host", req.URL.Host),
+			slog.Int("status", status), slog.Any("error", err), slog.Int("attempt", attempt+1),
+			slog.Duration("took", time.Since(start)), slog.Duration("wait", wait))
+		if resp != nil {
+			// reading the body to the end lets the connection be reused
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			pc.release(probe)
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// allow is whether a call can be made, probe is set for the one call that
+// checks on a provider after a pause.
+func (pc *ProviderClient) allow() (probe bool, err error) {
+	if pc.BreakerFailures <= 0 {
+		return false, nil
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if time.Now().Before(pc.openUntil) || pc.probing {
+		return false, ErrCircuitOpen
+	}
+	if pc.failures >= pc.BreakerFailures {
+		pc.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// release lets another call check on the provider when a probe was given up.
+func (pc *ProviderClient) release(probe bool) {
+	if !probe {
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.probing = false
+}
+
+// finish records how a call went, a Retry-After pauses the calls at least
+// that long.
+func (pc *ProviderClient) finish(probe, ok bool, retryAfter time.Duration) {
+	if pc.BreakerFailures <= 0 {
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if probe {
+		pc.probing = false
+	}
+	if ok {
+		if pc.failures >= pc.BreakerFailures {
+			pc.logger().Info("Provider is back, resuming calls", slog.String("provider", pc.Name))
+		}
+		pc.failures = 0
+		return
+	}
+	pc.failures++
+	pause := time.Duration(0)
+	if pc.failures >= pc.BreakerFailures {
+		pause = pc.BreakerCooldown
+		if pause <= 0 {
+			pause = time.Minute
+		}
+	}
+	pause = max(pause, retryAfter)
+	if pause > 0 {
+		pc.openUntil = time.Now().Add(pause)
+		pc.logger().Error("Pausing provider calls", slog.String("provider", pc.Name),
+			slog.Int("failures", pc.failures), slog.Duration("pause", pause))
+	}
+}
+
+// backoff is the wait before retry attempt+1: Backoff doubled for each
+// earlier retry, half of it random so clients don't retry in lockstep.
+func (pc *ProviderClient) backoff(attempt int) time.Duration {
+	base := pc.Backoff
+	if base <= 0 {
+		base = 500 * time.Millisecond
+	}
+	delay := min(base<<attempt, pc.maxBackoff())
+	return delay/2 + rand.N(delay/2+1)
+}
+
+func (pc *ProviderClient) maxBackoff() time.Duration {
+	if pc.MaxBackoff <= 0 {
+		return 10 * time.Second
+	}
+	return pc.MaxBackoff
+}
+
+func (pc *ProviderClient) logger() *slog.Logger {
+	if pc.Logger == nil {
+		return slog.Default()
+	}
+	return pc.Logger
+}
+
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// parseRetryAfter reads a Retry-After header, either seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrProviderUnauthorized is returned when the provider rejects the API key
+	ErrProviderUnauthorized = errors.New("API key rejected")
+	// ErrProviderQuota is returned when the provider's own limit for the key
+	// is used up
+	ErrProviderQuota = errors.New("API quota exceeded")
+	// ErrProviderNotFound is returned when the provider doesn't know what was
+	// asked for
+	ErrProviderNotFound = errors.New("not found")
+	// ErrProviderUnavailable is returned when the provider can't be reached or
+	// answers with a server error
+	ErrProviderUnavailable = errors.New("provider unavailable")
+	// ErrProviderDecode is returned when the provider's response can't be read
+	ErrProviderDecode = errors.New("unreadable response")
+)
+
+// ProviderError is a call to a provider that failed. Kind is one of the
+// ErrProvider errors, or nil for a status the app doesn't expect, so callers
+// can use errors.Is.
+type ProviderError struct {
+	Provider string
+	Kind     error
+	// StatusCode is the HTTP status, 0 when there was no response
+	StatusCode int
+	// Message is what the provider said went wrong, if anything
+	Message string
+	// Err is the underlying error, e.g. a timeout or a JSON syntax error
+	Err error
+}
+
+func (pe *ProviderError) Error() string {
+	msg := pe.Provider
+	if pe.Kind != nil {
+		msg += ": " + pe.Kind.Error()
+	}
+	if pe.StatusCode != 0 {
+		msg += fmt.Sprintf(" (status %d)", pe.StatusCode)
+	}
+	if pe.Message != "" {
+		msg += ": " + pe.Message
+	}
+	if pe.Err != nil {
+		msg += ": " + pe.Err.Error()
+	}
+	return msg
+}
+
+func (pe *ProviderError) Unwrap() []error {
+	var errs []error
+	if pe.Kind != nil {
+		errs = append(errs, pe.Kind)
+	}
+	if pe.Err != nil {
+		errs = append(errs, pe.Err)
+	}
+	return errs
+}
@@ -0,0 +1,17 @@
+package models
+
+import "context"
+
+// RefreshHook is told about a location every time its conditions are
+// refreshed from the provider, along with any alerts that weren't seen before.
+// The context isn't cancelled when the request that caused the refresh ends, so
+// hooks can keep working in the background.
+type RefreshHook interface {
+	LocationRefreshed(ctx context.Context, location *Location, newAlerts []Alert)
+}
+
+// DeleteHook is told when a user deletes one of their locations, so anything
+// published for it can be taken down.
+type DeleteHook interface {
+	LocationDeleted(ctx context.Context, locationID int)
+}
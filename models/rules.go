@@ -0,0 +1,418 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/daniel-z-johnson/personal-weather/units"
+)
+
+const (
+	// RuleThreshold compares one of the stored metrics to a threshold
+	RuleThreshold = "threshold"
+	// RuleAlert fires for every new severe weather alert
+	RuleAlert = "alert"
+)
+
+// Metrics a threshold rule can watch. Thresholds are in the unit the metric
+// is stored in: °C, percent, hPa and m/s.
+const (
+	MetricTemperature = "temperature"
+	MetricFeelsLike   = "feels_like"
+	MetricHumidity    = "humidity"
+	MetricPressure    = "pressure"
+	MetricWindSpeed   = "wind_speed"
+)
+
+var Metrics = []string{MetricTemperature, MetricFeelsLike, MetricHumidity, MetricPressure, MetricWindSpeed}
+
+var Operators = []string{"<", "<=", ">", ">="}
+
+// NotificationRule decides when a refreshed location is worth a notification.
+type NotificationRule struct {
+	Name string
+	Kind string
+	// Location is the city the rule watches, empty watches every location
+	Location  string
+	Condition ThresholdCondition
+	Sinks     []string
+	// MinInterval is the least time between two notifications from this rule
+	// for the same location
+	MinInterval time.Duration
+	QuietHours  QuietHours
+}
+
+// ThresholdCondition is e.g. "temperature < 0 for 2h". Once it has fired it
+// stays firing until the metric is Hysteresis past the threshold the other
+// way, so a reading bouncing around the threshold only notifies once.
+type ThresholdCondition struct {
+	Metric     string
+	Operator   string
+	Threshold  float64
+	Hysteresis float64
+	For        time.Duration
+}
+
+func (c ThresholdCondition) met(value float64) bool {
+	switch c.Operator {
+	case "<":
+		return value < c.Threshold
+	case "<=":
+		return value <= c.Threshold
+	case ">":
+		return value > c.Threshold
+	case ">=":
+		return value >= c.Threshold
+	}
+	return false
+}
+
+// cleared is whether a firing condition should reset
+func (c ThresholdCondition) cleared(value float64) bool {
+	if strings.HasPrefix(c.Operator, "<") {
+		return value >= c.Threshold+c.Hysteresis
+	}
+	return value <= c.Threshold-c.Hysteresis
+}
+
+func (c ThresholdCondition) String() string {
+	s := fmt.Sprintf("%s %s %s", strings.ReplaceAll(c.Metric, "_", " "), c.Operator, formatMetric(c.Metric, c.Threshold))
+	if c.For > 0 {
+		s += " for " + c.For.String()
+	}
+	if c.Hysteresis > 0 {
+		s += fmt.Sprintf(" (hysteresis %.1f %s)", c.Hysteresis, metricUnits[c.Metric])
+	}
+	return s
+}
+
+// QuietHours is a daily window, in server local time, when rules don't send
+// notifications. Threshold rules that fire during it notify once it's over if
+// they're still firing, alerts issued during it are sent by the first refresh
+// after it if they're still in effect. The window can wrap past midnight,
+// e.g. 22:00 to 07:00.
+type QuietHours struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseQuietHours reads "HH:MM" start and end times, two empty strings mean
+// no quiet hours.
+func ParseQuietHours(start, end string) (QuietHours, error) {
+	if start == "" && end == "" {
+		return QuietHours{}, nil
+	}
+	var q QuietHours
+	for _, part := range []struct {
+		value string
+		into  *time.Duration
+	}{{start, &q.Start}, {end, &q.End}} {
+		t, err := time.Parse("15:04", part.value)
+		if err != nil {
+			return QuietHours{}, fmt.Errorf("quiet hours must look like 22:00: %w", err)
+		}
+		*part.into = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return q, nil
+}
+
+func (q QuietHours) Contains(t time.Time) bool {
+	if q.Start == q.End {
+		return false
+	}
+	now := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if q.Start < q.End {
+		return now >= q.Start && now < q.End
+	}
+	return now >= q.Start || now < q.End
+}
+
+func (q QuietHours) String() string {
+	if q.Start == q.End {
+		return ""
+	}
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return clock(q.Start) + " to " + clock(q.End)
+}
+
+func (rule NotificationRule) matchesLocation(location *Location) bool {
+	return rule.Location == "" || strings.EqualFold(rule.Location, location.City)
+}
+
+// MetricValue returns the metric from the location in its stored unit.
+func MetricValue(location *Location, metric string) (float64, bool) {
+	switch metric {
+	case MetricTemperature:
+		return location.Temperature.Celsius(), true
+	case MetricFeelsLike:
+		return location.FeelsLike.Celsius(), true
+	case MetricHumidity:
+		return location.Humidity, true
+	case MetricPressure:
+		return location.Pressure, true
+	case MetricWindSpeed:
+		return location.WindSpeed, true
+	}
+	return 0, false
+}
+
+// metricUnits are the units metrics are stored and compared in
+var metricUnits = map[string]string{
+	MetricTemperature: "°C",
+	MetricFeelsLike:   "°C",
+	MetricHumidity:    "%",
+	MetricPressure:    string(units.Hectopascals),
+	MetricWindSpeed:   string(units.MetersPerSecond),
+}
+
+func formatMetric(metric string, value float64) string {
+	switch metric {
+	case MetricTemperature, MetricFeelsLike:
+		return fmt.Sprintf("%.1f°C (%.1f°F)", value, value*9/5+32)
+	case MetricHumidity:
+		return fmt.Sprintf("%.f%%", value)
+	case MetricPressure:
+		return fmt.Sprintf("%.f hPa", value)
+	case MetricWindSpeed:
+		return fmt.Sprintf("%.1f m/s (%.1f mph)", value, units.ConvertSpeed(value, units.MetersPerSecond, units.MilesPerHour))
+	}
+	return fmt.Sprintf("%g", value)
+}
+
+const (
+	ruleClear   = "clear"
+	rulePending = "pending"
+	ruleFiring  = "firing"
+)
+
+// RuleState is where a threshold rule is for one place. Locations at the same
+// coordinates share it, so a rule notifies once however many users saved them.
+type RuleState struct {
+	Rule      string
+	Latitude  float64
+	Longitude float64
+	// City is the name of a location at the coordinates
+	City  string
+	State string
+	// Since is when the condition was first met
+	Since        time.Time
+	Notified     bool
+	LastNotified time.Time
+}
+
+// RuleEvaluator runs threshold rules and picks the alerts alert rules notify
+// about, keeping what was notified in SQLite so a restart doesn't notify about
+// it again.
+type RuleEvaluator struct {
+	DB     *sql.DB
+	Logger *slog.Logger
+}
+
+// Evaluate moves the rule's state for the location along and reports whether
+// a notification should be sent now.
+func (re *RuleEvaluator) Evaluate(ctx context.Context, rule NotificationRule, location *Location, now time.Time) (bool, error) {
+	value, ok := MetricValue(location, rule.Condition.Metric)
+	if !ok {
+		return false, fmt.Errorf("rule %q watches unknown metric %q", rule.Name, rule.Condition.Metric)
+	}
+	state, err := re.getState(ctx, rule.Name, location.Latitude, location.Longitude)
+	if err != nil {
+		return false, err
+	}
+	met := rule.Condition.met(value)
+	switch state.State {
+	case ruleClear:
+		if met {
+			state.State = rulePending
+			state.Since = now
+		}
+	case rulePending:
+		if !met {
+			// the condition has to hold for the whole duration
+			state.State = ruleClear
+		}
+	case ruleFiring:
+		if rule.Condition.cleared(value) {
+			state.State = ruleClear
+			state.Notified = false
+		}
+	}
+	if state.State == rulePending && now.Sub(state.Since) >= rule.Condition.For {
+		state.State = ruleFiring
+		state.Notified = false
+	}
+	notify := false
+	if state.State == ruleFiring && !state.Notified && !rule.QuietHours.Contains(now) {
+		// a firing held back by MinInterval stays unnotified, so it's sent
+		// once the interval has passed if the condition still holds
+		if state.LastNotified.IsZero() || now.Sub(state.LastNotified) >= rule.MinInterval {
+			notify = true
+			state.Notified = true
+			state.LastNotified = now
+		} else {
+			re.Logger.Info("Notification rate limited", slog.String("rule", rule.Name), slog.Int("location_id", location.ID))
+		}
+	}
+	if err := re.saveState(ctx, state); err != nil {
+		return false, err
+	}
+	return notify, nil
+}
+
+// States returns every rule's state, for showing on the notifications page.
+func (re *RuleEvaluator) States(ctx context.Context) ([]RuleState, error) {
+	rows, err := re.DB.QueryContext(ctx, ruleStateQuery+` ORDER BY rule, latitude, longitude`)
+	if err != nil {
+		re.Logger.Error("Failed to get rule states", slog.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+	states := make([]RuleState, 0)
+	for rows.Next() {
+		state, err := scanRuleState(rows)
+		if err != nil {
+			re.Logger.Error("Failed to scan rule state row", slog.String("error", err.Error()))
+			return nil, err
+		}
+		states = append(states, *state)
+	}
+	if err = rows.Err(); err != nil {
+		re.Logger.Error("Error iterating over rule state rows", slog.String("error", err.Error()))
+		return nil, err
+	}
+	return states, nil
+}
+
+func (re *RuleEvaluator) getState(ctx context.Context, rule string, latitude, longitude float64) (*RuleState, error) {
+	row := re.DB.QueryRowContext(ctx, ruleStateQuery+` WHERE rule = ? AND latitude = ? AND longitude = ?`, rule, latitude, longitude)
+	state, err := scanRuleState(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &RuleState{Rule: rule, Latitude: latitude, Longitude: longitude, State: ruleClear}, nil
+	}
+	if err != nil {
+		re.Logger.Error("Failed to get rule state", slog.String("rule", rule), slog.Float64("latitude", latitude),
+			slog.Float64("longitude", longitude), slog.String("error", err.Error()))
+		return nil, err
+	}
+	return state, nil
+}
+
+func (re *RuleEvaluator) saveState(ctx context.Context, state *RuleState) error {
+	lastNotified := ""
+	if !state.LastNotified.IsZero() {
+		lastNotified = state.LastNotified.Format(time.DateTime)
+	}
+	_, err := re.DB.ExecContext(ctx, `INSERT INTO rule_state (rule, latitude, longitude, state, since, notified, last_notified)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (rule, latitude, longitude) DO UPDATE SET state = excluded.state, since = excluded.since,
+		notified = excluded.notified, last_notified = excluded.last_notified`,
+		state.Rule, state.Latitude, state.Longitude, state.State, state.Since.Format(time.DateTime), state.Notified, lastNotified)
+	if err != nil {
+		re.Logger.Error("Failed to save rule state", slog.String("rule", state.Rule), slog.Float64("latitude", state.Latitude),
+			slog.Float64("longitude", state.Longitude), slog.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// ruleStateQuery selects what scanRuleState reads, the city is from any
+// location at the coordinates
+const ruleStateQuery = `SELECT rule, latitude, longitude, state, since, notified, last_notified,
+	COALESCE((SELECT city FROM locations l WHERE l.latitude = r.latitude AND l.longitude = r.longitude LIMIT 1), '')
+	FROM rule_state r`
+
+func scanRuleState(row interface{ Scan(...any) error }) (*RuleState, error) {
+	var state RuleState
+	var since, lastNotified string
+	err := row.Scan(&state.Rule, &state.Latitude, &state.Longitude, &state.State, &since, &state.Notified, &lastNotified, &state.City)
+	if err != nil {
+		return nil, err
+	}
+	state.Since, _ = time.ParseInLocation(time.DateTime, since, time.Local)
+	if lastNotified != "" {
+		state.LastNotified, _ = time.ParseInLocation(time.DateTime, lastNotified, time.Local)
+	}
+	return &state, nil
+}
+
+// AlertsToNotify returns the alerts in effect at the location's coordinates
+// that the rule hasn't notified about. They're marked notified as they're
+// returned, so the other locations at the coordinates don't get them too.
+func (re *RuleEvaluator) AlertsToNotify(ctx context.Context, rule NotificationRule, location *Location, now time.Time) ([]Alert, error) {
+	alerts, err := re.activeAlertsAt(ctx, location, now)
+	if err != nil {
+		return nil, err
+	}
+	nowText := now.Format(time.DateTime)
+	toNotify := make([]Alert, 0, len(alerts))
+	for _, alert := range alerts {
+		until := alert.End
+		if next := now.Add(rule.MinInterval); next.After(until) {
+			until = next
+		}
+		// claiming in one statement keeps two refreshes of the place from
+		// both sending it
+		result, err := re.DB.ExecContext(ctx, `INSERT INTO alert_notifications (rule, latitude, longitude, sender, event, start, until)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (rule, latitude, longitude, sender, event, start) DO UPDATE SET until = excluded.until
+			WHERE alert_notifications.until <= ?`,
+			rule.Name, location.Latitude, location.Longitude, alert.Sender, alert.Event, alert.Start.Format(time.DateTime),
+			until.Format(time.DateTime), nowText)
+		if err != nil {
+			re.Logger.Error("Failed to mark alert notified", slog.String("rule", rule.Name), slog.String("event", alert.Event),
+				slog.String("error", err.Error()))
+			return nil, err
+		}
+		claimed, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if claimed == 1 {
+			toNotify = append(toNotify, alert)
+		}
+	}
+	_, err = re.DB.ExecContext(ctx, `DELETE FROM alert_notifications WHERE until < ?`, now.Add(-alertRetention).Format(time.DateTime))
+	if err != nil {
+		re.Logger.Error("Failed to delete old alert notifications", slog.String("error", err.Error()))
+		return nil, err
+	}
+	return toNotify, nil
+}
+
+// activeAlertsAt returns the alerts in effect at the location's coordinates,
+// each once however many locations saved it.
+func (re *RuleEvaluator) activeAlertsAt(ctx context.Context, location *Location, now time.Time) ([]Alert, error) {
+	rows, err := re.DB.QueryContext(ctx, `SELECT a.sender, a.event, a.start, MAX(a.end), MAX(a.description)
+		FROM alerts a JOIN locations l ON l.id = a.location_id
+		WHERE l.latitude = ? AND l.longitude = ? AND a.end > ?
+		GROUP BY a.sender, a.event, a.start ORDER BY a.start, a.event`, location.Latitude, location.Longitude, now.Format(time.DateTime))
+	if err != nil {
+		re.Logger.Error("Failed to get active alerts", slog.Int("location_id", location.ID), slog.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+	alerts := make([]Alert, 0)
+	for rows.Next() {
+		alert := Alert{LocationID: location.ID, City: location.City, State: location.State, Country: location.Country}
+		var start, end string
+		if err := rows.Scan(&alert.Sender, &alert.Event, &start, &end, &alert.Description); err != nil {
+			re.Logger.Error("Failed to scan alert row", slog.String("error", err.Error()))
+			return nil, err
+		}
+		alert.Start, _ = time.ParseInLocation(time.DateTime, start, time.Local)
+		alert.End, _ = time.ParseInLocation(time.DateTime, end, time.Local)
+		alerts = append(alerts, alert)
+	}
+	if err = rows.Err(); err != nil {
+		re.Logger.Error("Error iterating over alert rows", slog.String("error", err.Error()))
+		return nil, err
+	}
+	return alerts, nil
+}
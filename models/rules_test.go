@@ -0,0 +1,317 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/daniel-z-johnson/personal-weather/units"
+)
+
+// recordingSink passes what it's sent to a channel.
+type recordingSink chan Notification
+
+func (rs recordingSink) Name() string { return "recording" }
+
+func (rs recordingSink) Send(_ context.Context, n Notification) error {
+	rs <- n
+	return nil
+}
+
+// notified is the notifications sent within a moment, the sinks are called
+// in the background.
+func (rs recordingSink) notified() []Notification {
+	var sent []Notification
+	for {
+		select {
+		case n := <-rs:
+			sent = append(sent, n)
+		case <-time.After(200 * time.Millisecond):
+			return sent
+		}
+	}
+}
+
+func testNotifier(t *testing.T, rule NotificationRule) (*Notifier, recordingSink) {
+	t.Helper()
+	sink := make(recordingSink, 10)
+	rule.Sinks = []string{sink.Name()}
+	return &Notifier{Logger: testLogger(), Sinks: map[string]NotificationSink{sink.Name(): sink}, Rules: []NotificationRule{rule},
+		Evaluator: &RuleEvaluator{DB: openTestDB(t), Logger: testLogger()}}, sink
+}
+
+// sameCity is the copies of one city saved by two users.
+func sameCity() []*Location {
+	locations := make([]*Location, 0, 2)
+	for id := 1; id <= 2; id++ {
+		locations = append(locations, &Location{ID: id, City: "Duluth", State: "MN", Country: "US", Latitude: 46.78,
+			Longitude: -92.1, Temperature: units.FromCelsius(-10)})
+	}
+	return locations
+}
+
+func TestThresholdRuleNotifiesOncePerPlace(t *testing.T) {
+	notifier, sink := testNotifier(t, NotificationRule{Name: "freezing", Kind: RuleThreshold,
+		Condition: ThresholdCondition{Metric: MetricTemperature, Operator: "<", Threshold: 0}})
+	for _, location := range sameCity() {
+		notifier.LocationRefreshed(context.Background(), location, nil)
+	}
+	if sent := sink.notified(); len(sent) != 1 {
+		t.Fatalf("sent %d notifications, want 1: %v", len(sent), sent)
+	}
+
+	states, err := notifier.Evaluator.States(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states[0].State != ruleFiring || states[0].Latitude != 46.78 {
+		t.Errorf("states = %+v", states)
+	}
+}
+
+// saveSameCity saves sameCity with the alert, as a refresh would.
+func saveSameCity(t *testing.T, db *sql.DB, alert Alert) []*Location {
+	t.Helper()
+	ws := &WeatherService{DB: db, Logger: testLogger()}
+	locations := sameCity()
+	for _, location := range locations {
+		id, err := ws.SaveLocation(context.Background(), location.ID, location.City, location.State, location.Country,
+			location.Latitude, location.Longitude, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		location.ID = id
+	}
+	saveAlert(t, db, locations, alert)
+	return locations
+}
+
+// saveAlert saves the alert for every copy of the city.
+func saveAlert(t *testing.T, db *sql.DB, locations []*Location, alert Alert) {
+	t.Helper()
+	ws := &WeatherService{DB: db, Logger: testLogger()}
+	for _, location := range locations {
+		if _, err := ws.SaveAlerts(context.Background(), location.ID, []Alert{alert}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func winterStorm() Alert {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	return Alert{Sender: "NWS Duluth", Event: "Winter Storm Warning", Start: start, End: start.Add(12 * time.Hour)}
+}
+
+func TestAlertRuleNotifiesOncePerPlace(t *testing.T) {
+	notifier, sink := testNotifier(t, NotificationRule{Name: "alerts", Kind: RuleAlert})
+	storm := winterStorm()
+	locations := saveSameCity(t, notifier.Evaluator.DB, storm)
+	for _, location := range locations {
+		notifier.LocationRefreshed(context.Background(), location, []Alert{storm})
+	}
+	if sent := sink.notified(); len(sent) != 1 {
+		t.Fatalf("sent %d notifications, want 1: %v", len(sent), sent)
+	}
+
+	// a different alert at the same place still gets through
+	advisory := Alert{Sender: "NWS Duluth", Event: "Wind Chill Advisory", Start: storm.Start, End: storm.Start.Add(6 * time.Hour)}
+	saveAlert(t, notifier.Evaluator.DB, locations, advisory)
+	notifier.LocationRefreshed(context.Background(), locations[0], []Alert{advisory})
+	if sent := sink.notified(); len(sent) != 1 || sent[0].Title != "Duluth, MN: Wind Chill Advisory" {
+		t.Fatalf("sent %v for a new alert, want the advisory", sent)
+	}
+}
+
+func TestAlertRuleQuietHoursAndRestart(t *testing.T) {
+	// quiet hours from an hour ago to an hour from now
+	now := time.Now()
+	sinceMidnight := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	quiet := QuietHours{Start: (sinceMidnight + 23*time.Hour) % (24 * time.Hour), End: (sinceMidnight + time.Hour) % (24 * time.Hour)}
+	notifier, sink := testNotifier(t, NotificationRule{Name: "alerts", Kind: RuleAlert, QuietHours: quiet})
+	storm := winterStorm()
+	location := saveSameCity(t, notifier.Evaluator.DB, storm)[0]
+	notifier.LocationRefreshed(context.Background(), location, []Alert{storm})
+	if sent := sink.notified(); len(sent) != 0 {
+		t.Fatalf("sent %v during quiet hours", sent)
+	}
+
+	// quiet hours are over, the storm isn't new any more but is still sent
+	notifier.Rules[0].QuietHours = QuietHours{}
+	notifier.LocationRefreshed(context.Background(), location, nil)
+	if sent := sink.notified(); len(sent) != 1 {
+		t.Fatalf("sent %d notifications after quiet hours, want 1", len(sent))
+	}
+
+	restarted, sink := testNotifier(t, notifier.Rules[0])
+	restarted.Evaluator = &RuleEvaluator{DB: notifier.Evaluator.DB, Logger: testLogger()}
+	restarted.LocationRefreshed(context.Background(), location, nil)
+	if sent := sink.notified(); len(sent) != 0 {
+		t.Fatalf("sent %v again after a restart", sent)
+	}
+}
+
+// evaluate runs the rule on Duluth at the temperature.
+func evaluate(t *testing.T, re *RuleEvaluator, rule NotificationRule, celsius float64, now time.Time) bool {
+	t.Helper()
+	location := sameCity()[0]
+	location.Temperature = units.FromCelsius(celsius)
+	notify, err := re.Evaluate(context.Background(), rule, location, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return notify
+}
+
+func TestMinIntervalDefersFiring(t *testing.T) {
+	re := &RuleEvaluator{DB: openTestDB(t), Logger: testLogger()}
+	rule := NotificationRule{Name: "freezing", Kind: RuleThreshold, MinInterval: time.Hour,
+		Condition: ThresholdCondition{Metric: MetricTemperature, Operator: "<", Threshold: 0}}
+	start := time.Date(2026, 1, 2, 12, 0, 0, 0, time.Local)
+	if !evaluate(t, re, rule, -5, start) {
+		t.Fatal("first firing not notified")
+	}
+	// clears and fires again within the hour
+	evaluate(t, re, rule, 5, start.Add(10*time.Minute))
+	if evaluate(t, re, rule, -5, start.Add(20*time.Minute)) {
+		t.Error("notified again within MinInterval")
+	}
+	if evaluate(t, re, rule, -5, start.Add(40*time.Minute)) {
+		t.Error("notified again within MinInterval")
+	}
+	if !evaluate(t, re, rule, -5, start.Add(61*time.Minute)) {
+		t.Error("firing held back by MinInterval not sent once it passed")
+	}
+	if evaluate(t, re, rule, -5, start.Add(70*time.Minute)) {
+		t.Error("one firing notified twice")
+	}
+}
+
+func TestThresholdRuleStates(t *testing.T) {
+	freezing := ThresholdCondition{Metric: MetricTemperature, Operator: "<", Threshold: 0}
+	// readings are hours after 20:00
+	type reading struct {
+		hour    time.Duration
+		celsius float64
+		notify  bool
+		state   string
+	}
+	for _, tc := range []struct {
+		name     string
+		rule     NotificationRule
+		readings []reading
+	}{
+		{"fires at once", NotificationRule{Condition: freezing}, []reading{
+			{0, 1, false, ruleClear},
+			{1, -1, true, ruleFiring},
+			{2, -2, false, ruleFiring},
+		}},
+		{"for moves pending to firing", NotificationRule{Condition: ThresholdCondition{Metric: MetricTemperature, Operator: "<", Threshold: 0, For: 2 * time.Hour}}, []reading{
+			{0, -1, false, rulePending},
+			{1, -1, false, rulePending},
+			{2, -1, true, ruleFiring},
+		}},
+		{"pending clears when the condition drops", NotificationRule{Condition: ThresholdCondition{Metric: MetricTemperature, Operator: "<", Threshold: 0, For: 2 * time.Hour}}, []reading{
+			{0, -1, false, rulePending},
+			{1, 1, false, ruleClear},
+			{2, -1, false, rulePending},
+			{3, -1, false, rulePending},
+			{4, -1, true, ruleFiring},
+		}},
+		{"hysteresis", NotificationRule{Condition: ThresholdCondition{Metric: MetricTemperature, Operator: "<", Threshold: 0, Hysteresis: 2}}, []reading{
+			{0, -1, true, ruleFiring},
+			{1, 1, false, ruleFiring},
+			{2, -1, false, ruleFiring},
+			{3, 2, false, ruleClear},
+			{4, -1, true, ruleFiring},
+		}},
+		{"quiet hours defer a firing", NotificationRule{Condition: freezing, QuietHours: QuietHours{Start: 22 * time.Hour, End: 7 * time.Hour}}, []reading{
+			{3, -1, false, ruleFiring},
+			{7, -1, false, ruleFiring},
+			{11, -1, true, ruleFiring},
+			{12, -1, false, ruleFiring},
+		}},
+		{"cleared during quiet hours", NotificationRule{Condition: freezing, QuietHours: QuietHours{Start: 22 * time.Hour, End: 7 * time.Hour}}, []reading{
+			{3, -1, false, ruleFiring},
+			{5, 1, false, ruleClear},
+			{11, 1, false, ruleClear},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			re := &RuleEvaluator{DB: openTestDB(t), Logger: testLogger()}
+			tc.rule.Name = "freezing"
+			tc.rule.Kind = RuleThreshold
+			evening := time.Date(2026, 1, 2, 20, 0, 0, 0, time.Local)
+			for _, r := range tc.readings {
+				now := evening.Add(r.hour * time.Hour)
+				if notify := evaluate(t, re, tc.rule, r.celsius, now); notify != r.notify {
+					t.Errorf("%s at %.0f°C: notify = %v, want %v", now.Format("15:04"), r.celsius, notify, r.notify)
+				}
+				state, err := re.getState(context.Background(), tc.rule.Name, 46.78, -92.1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if state.State != r.state {
+					t.Errorf("%s at %.0f°C: state = %s, want %s", now.Format("15:04"), r.celsius, state.State, r.state)
+				}
+			}
+		})
+	}
+}
+
+func TestQuietHoursContains(t *testing.T) {
+	for _, tc := range []struct {
+		start, end string
+		at         string
+		want       bool
+	}{
+		{"22:00", "07:00", "21:59", false},
+		{"22:00", "07:00", "22:00", true},
+		{"22:00", "07:00", "23:30", true},
+		{"22:00", "07:00", "00:00", true},
+		{"22:00", "07:00", "06:59", true},
+		{"22:00", "07:00", "07:00", false},
+		{"22:00", "07:00", "12:00", false},
+		{"09:00", "17:00", "08:59", false},
+		{"09:00", "17:00", "09:00", true},
+		{"09:00", "17:00", "16:59", true},
+		{"09:00", "17:00", "17:00", false},
+		{"", "", "03:00", false},
+		{"08:00", "08:00", "08:00", false},
+	} {
+		quiet, err := ParseQuietHours(tc.start, tc.end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock, err := time.Parse("15:04", tc.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at := time.Date(2026, 1, 2, clock.Hour(), clock.Minute(), 0, 0, time.Local)
+		if got := quiet.Contains(at); got != tc.want {
+			t.Errorf("%s to %s contains %s = %v, want %v", tc.start, tc.end, tc.at, got, tc.want)
+		}
+	}
+}
+
+func TestRuleStateSurvivesRestart(t *testing.T) {
+	db := openTestDB(t)
+	rule := NotificationRule{Name: "freezing", Kind: RuleThreshold,
+		Condition: ThresholdCondition{Metric: MetricTemperature, Operator: "<", Threshold: 0}}
+	now := time.Date(2026, 1, 2, 12, 0, 0, 0, time.Local)
+	if !evaluate(t, &RuleEvaluator{DB: db, Logger: testLogger()}, rule, -5, now) {
+		t.Fatal("first firing not notified")
+	}
+	// a new evaluator is what the server has after a restart
+	restarted := &RuleEvaluator{DB: db, Logger: testLogger()}
+	if evaluate(t, restarted, rule, -5, now.Add(time.Hour)) {
+		t.Error("firing notified again after a restart")
+	}
+	states, err := restarted.States(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states[0].State != ruleFiring || !states[0].Notified || !states[0].LastNotified.Equal(now) {
+		t.Errorf("states = %+v", states)
+	}
+}
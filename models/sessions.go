@@ -0,0 +1,74 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// SessionService keeps users signed in. Only a hash of each session token is
+// stored, so the sessions table can't be used to sign in.
+type SessionService struct {
+	DB     *sql.DB
+	Logger *slog.Logger
+	// TTL is how long a session lasts
+	TTL time.Duration
+}
+
+// Create starts a session for the user and returns its token for the cookie.
+func (ss *SessionService) Create(ctx context.Context, userID int) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+	// a good time to forget old sessions
+	if _, err := ss.DB.ExecContext(ctx, `DELETE FROM sessions WHERE expires_at < ?`, now.Format(time.DateTime)); err != nil {
+		ss.Logger.Warn("Failed to prune sessions", slog.String("error", err.Error()))
+	}
+	_, err := ss.DB.ExecContext(ctx, `INSERT INTO sessions (token_hash, user_id, expires_at) VALUES (?, ?, ?)`,
+		hashToken(token), userID, now.Add(ss.TTL).Format(time.DateTime))
+	if err != nil {
+		ss.Logger.Error("Failed to create session", slog.Int("user_id", userID), slog.String("error", err.Error()))
+		return "", err
+	}
+	return token, nil
+}
+
+// User returns the user signed in with the token, nil when the session is
+// unknown or expired.
+func (ss *SessionService) User(ctx context.Context, token string) (*User, error) {
+	var user User
+	err := ss.DB.QueryRowContext(ctx, `SELECT users.id, users.username FROM sessions JOIN users ON users.id = sessions.user_id
+		WHERE sessions.token_hash = ? AND sessions.expires_at > ?`, hashToken(token), time.Now().Format(time.DateTime)).
+		Scan(&user.ID, &user.Username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		ss.Logger.Error("Failed to get session user", slog.String("error", err.Error()))
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (ss *SessionService) Delete(ctx context.Context, token string) error {
+	if _, err := ss.DB.ExecContext(ctx, `DELETE FROM sessions WHERE token_hash = ?`, hashToken(token)); err != nil {
+		ss.Logger.Error("Failed to delete session", slog.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// hashToken is how session and API tokens are stored.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
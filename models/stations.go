@@ -0,0 +1,157 @@
+package models
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daniel-z-johnson/personal-weather/units"
+)
+
+const (
+	ProviderOpenWeatherMap = "openweathermap"
+	// ProviderStation locations are personal weather stations pushing their
+	// own readings, they're never refreshed from the weather API
+	ProviderStation = "station"
+)
+
+// Station is a personal weather station allowed to upload readings. Weather
+// Underground compatible stations send their ID and Password, Ecowitt
+// stations send their Passkey.
+type Station struct {
+	ID        string
+	Password  string
+	Passkey   string
+	Name      string
+	State     string
+	Country   string
+	Latitude  float64
+	Longitude float64
+}
+
+// AuthenticateWunderground checks the ID and PASSWORD of an upload.
+func (s Station) AuthenticateWunderground(id, password string) bool {
+	return s.Password != "" && s.ID == id &&
+		subtle.ConstantTimeCompare([]byte(s.Password), []byte(password)) == 1
+}
+
+// AuthenticateEcowitt checks the PASSKEY of an upload.
+func (s Station) AuthenticateEcowitt(passkey string) bool {
+	return s.Passkey != "" && subtle.ConstantTimeCompare([]byte(s.Passkey), []byte(passkey)) == 1
+}
+
+// StationUserID owns the stations' locations, no user has it so every user
+// sees the stations but none can delete them, they come from the config.
+const StationUserID = 0
+
+// SaveStation creates the location a station's readings are stored in, or
+// updates its name and coordinates, and returns the location's id.
+func (ws *WeatherService) SaveStation(ctx context.Context, station Station) (int, error) {
+	query := `INSERT INTO locations (user_id, city, state, country, latitude, longitude, local_names, provider, station_id)
+		VALUES (?, ?, ?, ?, ?, ?, '{}', ?, ?)
+		ON CONFLICT (station_id) WHERE provider = 'station' DO UPDATE SET user_id = excluded.user_id, city = excluded.city,
+		state = excluded.state, country = excluded.country, latitude = excluded.latitude, longitude = excluded.longitude`
+	_, err := ws.DB.ExecContext(ctx, query, StationUserID, station.Name, station.State, station.Country, station.Latitude,
+		station.Longitude, ProviderStation, station.ID)
+	if err != nil {
+		ws.Logger.Error("Failed to save station", slog.String("station", station.Name), slog.String("error", err.Error()))
+		return 0, err
+	}
+	var id int
+	err = ws.DB.QueryRowContext(ctx, `SELECT id FROM locations WHERE provider = ? AND station_id = ?`, ProviderStation, station.ID).Scan(&id)
+	if err != nil {
+		ws.Logger.Error("Failed to get station location", slog.String("station", station.Name), slog.String("error", err.Error()))
+		return 0, err
+	}
+	ws.Logger.Info("Station saved successfully", slog.String("station", station.Name), slog.Int("id", id))
+	return id, nil
+}
+
+// GetStationLocationID returns 0 when the station has no location.
+func (ws *WeatherService) GetStationLocationID(ctx context.Context, stationID string) (int, error) {
+	var id int
+	err := ws.DB.QueryRowContext(ctx, `SELECT id FROM locations WHERE provider = ? AND station_id = ?`, ProviderStation, stationID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		ws.Logger.Error("Failed to get station location", slog.String("error", err.Error()))
+		return 0, err
+	}
+	return id, nil
+}
+
+// ParseStationUpload reads the readings of a Weather Underground or Ecowitt
+// upload. Both send imperial units under mostly the same names, Ecowitt calls
+// the pressure baromrelin.
+func ParseStationUpload(values url.Values) (*Conditions, error) {
+	conditions := &Conditions{Alerts: make([]Alert, 0)}
+	field := func(names ...string) (float64, bool, error) {
+		for _, name := range names {
+			value := values.Get(name)
+			if value == "" {
+				continue
+			}
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return 0, false, fmt.Errorf("%s is not a number: %q", name, value)
+			}
+			return f, true, nil
+		}
+		return 0, false, nil
+	}
+	tempF, ok, err := field("tempf")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("tempf is missing")
+	}
+	conditions.Temperature = units.FromFahrenheit(tempF)
+	conditions.FeelsLike = conditions.Temperature
+	// stations send the one that applies, if either
+	feelsLikeF, ok, err := field("windchillf", "heatindexf", "feelslikef")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		conditions.FeelsLike = units.FromFahrenheit(feelsLikeF)
+	}
+	if conditions.Humidity, _, err = field("humidity"); err != nil {
+		return nil, err
+	}
+	pressure, _, err := field("baromin", "baromrelin", "baromabsin")
+	if err != nil {
+		return nil, err
+	}
+	conditions.Pressure = units.ConvertPressure(pressure, units.InchesOfMercury, units.Hectopascals)
+	windSpeed, _, err := field("windspeedmph")
+	if err != nil {
+		return nil, err
+	}
+	conditions.WindSpeed = units.ConvertSpeed(windSpeed, units.MilesPerHour, units.MetersPerSecond)
+	conditions.Observed, err = parseStationTime(values.Get("dateutc"))
+	if err != nil {
+		return nil, err
+	}
+	return conditions, nil
+}
+
+// parseStationTime reads dateutc, "now" or missing means the upload is current.
+func parseStationTime(dateUTC string) (time.Time, error) {
+	if dateUTC == "" || strings.EqualFold(dateUTC, "now") {
+		return time.Now(), nil
+	}
+	observed, err := time.ParseInLocation(time.DateTime, dateUTC, time.UTC)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("dateutc must look like 2006-01-02 15:04:05: %w", err)
+	}
+	return observed.Local(), nil
+}
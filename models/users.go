@@ -0,0 +1,114 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrInvalidCredentials is returned for an unknown username or a wrong
+	// password, which one isn't said
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrUsernameTaken      = errors.New("username is taken")
+)
+
+const minPasswordLength = 8
+
+// DefaultUserID owns the locations saved before there were users, and every
+// location while authentication is off.
+const DefaultUserID = 1
+
+type User struct {
+	ID       int
+	Username string
+}
+
+// IsAdmin is whether the user can see the admin pages, only the first user,
+// the one created at setup, can.
+func (u *User) IsAdmin() bool {
+	return u.ID == DefaultUserID
+}
+
+type UserService struct {
+	DB     *sql.DB
+	Logger *slog.Logger
+}
+
+func (us *UserService) Create(ctx context.Context, username, password string) (*User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, errors.New("username is required")
+	}
+	if len(password) < minPasswordLength {
+		return nil, fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		// only happens for passwords longer than 72 bytes
+		return nil, fmt.Errorf("password can't be used: %w", err)
+	}
+	return us.insert(ctx, username, string(hash))
+}
+
+func (us *UserService) insert(ctx context.Context, username, hash string) (*User, error) {
+	result, err := us.DB.ExecContext(ctx, `INSERT INTO users (username, password_hash, created_at) VALUES (?, ?, ?)`,
+		username, hash, time.Now().Format(time.DateTime))
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return nil, ErrUsernameTaken
+		}
+		us.Logger.Error("Failed to create user", slog.String("username", username), slog.String("error", err.Error()))
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	us.Logger.Info("User created", slog.String("username", username), slog.Int64("id", id))
+	return &User{ID: int(id), Username: username}, nil
+}
+
+func (us *UserService) Authenticate(ctx context.Context, username, password string) (*User, error) {
+	var user User
+	var hash string
+	err := us.DB.QueryRowContext(ctx, `SELECT id, username, password_hash FROM users WHERE username = ?`, strings.TrimSpace(username)).
+		Scan(&user.ID, &user.Username, &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		// compare anyway so unknown usernames take as long as wrong passwords
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		us.Logger.Error("Failed to get user", slog.String("error", err.Error()))
+		return nil, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return &user, nil
+}
+
+// dummyPasswordHash is the hash of a password nobody knows
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte(rand.Text()), bcrypt.DefaultCost)
+	return hash
+})
+
+// Count is the number of users, 0 means the first one still has to be set up.
+func (us *UserService) Count(ctx context.Context) (int, error) {
+	var count int
+	if err := us.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM users`).Scan(&count); err != nil {
+		us.Logger.Error("Failed to count users", slog.String("error", err.Error()))
+		return 0, err
+	}
+	return count, nil
+}
@@ -1,13 +1,19 @@
 package models
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
 	"time"
+
+	"github.com/daniel-z-johnson/personal-weather/units"
 )
 
+var ErrLocationNotFound = errors.New("no location found")
+
 type WeatherService struct {
 	DB     *sql.DB
 	Logger *slog.Logger
@@ -20,26 +26,101 @@ type Location struct {
 	Country     string
 	Latitude    float64
 	Longitude   float64
-	Temperature float64
-	Expires     time.Time
+	Temperature units.Temperature
+	FeelsLike   units.Temperature
+	Humidity    float64
+	// Pressure is in hPa
+	Pressure float64
+	// WindSpeed is in m/s
+	WindSpeed  float64
+	ObservedAt time.Time
+	Expires    time.Time
+	LocalNames map[string]string
+	// Provider is ProviderOpenWeatherMap or ProviderStation
+	Provider string
+}
+
+// DisplayName is the city name in the given language when the geocoder knew
+// one, otherwise the English name.
+func (l Location) DisplayName(lang string) string {
+	if name := l.LocalNames[lang]; lang != "" && name != "" {
+		return name
+	}
+	return l.City
 }
 
-func (ws *WeatherService) SaveLocation(city, state, country string, latitude, longitude float64) error {
-	query := `INSERT INTO locations (city, state, country, latitude, longitude) VALUES (?, ?, ?, ?, ?)`
-	_, err := ws.DB.Exec(query, city, state, country, latitude, longitude)
+// SaveLocation adds a location for the user and returns its id.
+func (ws *WeatherService) SaveLocation(ctx context.Context, userID int, city, state, country string, latitude, longitude float64, localNames map[string]string) (int, error) {
+	encodedNames, err := json.Marshal(localNames)
+	if err != nil {
+		ws.Logger.Error("Failed to encode local names", slog.String("city", city), slog.String("error", err.Error()))
+		return 0, err
+	}
+	// the location and the conditions it shares are saved together, a failed
+	// copy doesn't leave a location behind that the caller was told failed
+	tx, err := ws.DB.BeginTx(ctx, nil)
+	if err != nil {
+		ws.Logger.Error("Failed to start saving location", slog.String("city", city), slog.String("error", err.Error()))
+		return 0, err
+	}
+	defer tx.Rollback()
+	query := `INSERT INTO locations (user_id, city, state, country, latitude, longitude, local_names) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	result, err := tx.ExecContext(ctx, query, userID, city, state, country, latitude, longitude, string(encodedNames))
 	if err != nil {
 		ws.Logger.Error("Failed to save location", slog.String("city", city), slog.String("state", state),
 			slog.String("country", country), slog.String("error", err.Error()))
-		return err
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := ws.copyFreshConditions(ctx, tx, int(id), latitude, longitude); err != nil {
+		return 0, err
 	}
-	ws.Logger.Info("Location saved successfully",
+	if err := tx.Commit(); err != nil {
+		ws.Logger.Error("Failed to commit location", slog.String("city", city), slog.String("error", err.Error()))
+		return 0, err
+	}
+	ws.Logger.Info("Location saved successfully", slog.Int("user_id", userID),
 		slog.String("city", city), slog.String("state", state), slog.String("country", country))
+	return int(id), nil
+}
+
+// copyFreshConditions gives a new location the conditions and alerts of
+// another user's location at the same coordinates, when they haven't expired,
+// so it doesn't cost an API call.
+func (ws *WeatherService) copyFreshConditions(ctx context.Context, tx *sql.Tx, id int, latitude, longitude float64) error {
+	var otherID int
+	err := tx.QueryRowContext(ctx, `SELECT id FROM locations WHERE latitude = ? AND longitude = ? AND id != ? AND provider != 'station'
+		AND expires > ? ORDER BY expires DESC LIMIT 1`, latitude, longitude, id, time.Now().Format(time.DateTime)).Scan(&otherID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		ws.Logger.Error("Failed to look for conditions to share", slog.Int("id", id), slog.String("error", err.Error()))
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE locations SET (expires, temp, feels_like, temp_unit, humidity, pressure, wind_speed, wind_unit,
+		observed_at) = (SELECT expires, temp, feels_like, temp_unit, humidity, pressure, wind_speed, wind_unit, observed_at
+		FROM locations WHERE id = ?) WHERE id = ?`, otherID, id)
+	if err != nil {
+		ws.Logger.Error("Failed to share conditions", slog.Int("id", id), slog.String("error", err.Error()))
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO alerts (location_id, sender, event, start, end, description)
+		SELECT ?, sender, event, start, end, description FROM alerts WHERE location_id = ?`, id, otherID)
+	if err != nil {
+		ws.Logger.Error("Failed to share alerts", slog.Int("id", id), slog.String("error", err.Error()))
+		return err
+	}
+	ws.Logger.Info("Location shares conditions", slog.Int("id", id), slog.Int("shared_from", otherID))
 	return nil
 }
 
-func (ws *WeatherService) GetLocation(city, state, country string) (*GeoLocation, error) {
+func (ws *WeatherService) GetLocation(ctx context.Context, city, state, country string) (*GeoLocation, error) {
 	query := `SELECT latitude, longitude FROM locations WHERE city = ? AND state = ? AND country = ?`
-	row := ws.DB.QueryRow(query, city, state, country)
+	row := ws.DB.QueryRowContext(ctx, query, city, state, country)
 	var location GeoLocation
 	location.Name = city
 	location.State = state
@@ -57,10 +138,14 @@ func (ws *WeatherService) GetLocation(city, state, country string) (*GeoLocation
 	return &location, nil
 }
 
-func (ws *WeatherService) GetAllExpired() ([]GeoLocation, error) {
-	query := `SELECT id, city, state, country, latitude, longitude FROM locations WHERE expires < ?`
+// GetAllExpired returns the user's locations that need new conditions, the
+// stalest first.
+func (ws *WeatherService) GetAllExpired(ctx context.Context, userID int) ([]GeoLocation, error) {
+	// stations push their own readings
+	query := `SELECT id, city, state, country, latitude, longitude FROM locations
+		WHERE user_id = ? AND expires < ? AND claimed_until < ? AND provider != 'station' ORDER BY expires`
 	dateTimeNow := time.Now().Format(time.DateTime)
-	rows, err := ws.DB.Query(query, dateTimeNow)
+	rows, err := ws.DB.QueryContext(ctx, query, userID, dateTimeNow, dateTimeNow)
 	if err != nil {
 		ws.Logger.Error("Failed to get expired locations", slog.String("error", err.Error()))
 		return nil, err
@@ -85,11 +170,30 @@ func (ws *WeatherService) GetAllExpired() ([]GeoLocation, error) {
 	return locations, nil
 }
 
-func (ws *WeatherService) GetAll() ([]Location, error) {
-	query := `SELECT id, city, state, country, latitude, longitude, temp  FROM locations`
-	rows, err := ws.DB.Query(query)
+// GetAll returns the user's locations and the stations, which every user sees.
+func (ws *WeatherService) GetAll(ctx context.Context, userID int) ([]Location, error) {
+	return ws.queryLocations(ctx, `WHERE user_id IN (?, ?)`, userID, StationUserID)
+}
+
+// GetLocationByID returns nil when there's no location with the id.
+func (ws *WeatherService) GetLocationByID(ctx context.Context, id int) (*Location, error) {
+	locations, err := ws.queryLocations(ctx, `WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(locations) == 0 {
+		ws.Logger.Warn("No location found", slog.Int("id", id))
+		return nil, nil
+	}
+	return &locations[0], nil
+}
+
+func (ws *WeatherService) queryLocations(ctx context.Context, where string, args ...any) ([]Location, error) {
+	query := `SELECT id, city, state, country, latitude, longitude, temp, feels_like, temp_unit, humidity, pressure,
+		wind_speed, wind_unit, observed_at, local_names, provider FROM locations ` + where
+	rows, err := ws.DB.QueryContext(ctx, query, args...)
 	if err != nil {
-		ws.Logger.Error("Failed to get all locations", slog.String("error", err.Error()))
+		ws.Logger.Error("Failed to get locations", slog.String("error", err.Error()))
 		return nil, err
 	}
 	defer rows.Close()
@@ -97,11 +201,30 @@ func (ws *WeatherService) GetAll() ([]Location, error) {
 	locations := make([]Location, 0)
 	for rows.Next() {
 		var loc Location
-		err := rows.Scan(&loc.ID, &loc.City, &loc.State, &loc.Country, &loc.Latitude, &loc.Longitude, &loc.Temperature)
+		var temp, feelsLike, windSpeed float64
+		var tempUnit, windUnit, observedAt, localNames string
+		err := rows.Scan(&loc.ID, &loc.City, &loc.State, &loc.Country, &loc.Latitude, &loc.Longitude, &temp,
+			&feelsLike, &tempUnit, &loc.Humidity, &loc.Pressure, &windSpeed, &windUnit, &observedAt, &localNames,
+			&loc.Provider)
 		if err != nil {
 			ws.Logger.Error("Failed to scan location row", slog.String("error", err.Error()))
 			return nil, err
 		}
+		if loc.Temperature, err = units.NewTemperature(temp, units.TemperatureUnit(tempUnit)); err != nil {
+			ws.Logger.Error("Failed to read location temperature", slog.Int("id", loc.ID), slog.String("error", err.Error()))
+			return nil, err
+		}
+		if loc.FeelsLike, err = units.NewTemperature(feelsLike, units.TemperatureUnit(tempUnit)); err != nil {
+			ws.Logger.Error("Failed to read location temperature", slog.Int("id", loc.ID), slog.String("error", err.Error()))
+			return nil, err
+		}
+		loc.WindSpeed = units.ConvertSpeed(windSpeed, units.SpeedUnit(windUnit), units.MetersPerSecond)
+		if observedAt != "" {
+			loc.ObservedAt, _ = time.ParseInLocation(time.DateTime, observedAt, time.Local)
+		}
+		if err := json.Unmarshal([]byte(localNames), &loc.LocalNames); err != nil {
+			ws.Logger.Warn("Failed to decode local names", slog.Int("id", loc.ID), slog.String("error", err.Error()))
+		}
 		locations = append(locations, loc)
 	}
 
@@ -113,10 +236,8 @@ func (ws *WeatherService) GetAll() ([]Location, error) {
 	return locations, nil
 }
 
-func (ws *WeatherService) UpdateLocation(id int, temp float64) error {
-	query := `UPDATE locations SET expires = ?, temp = ? WHERE id = ?`
-	dateTimeExpires := time.Now().Add(30 * time.Minute).Format(time.DateTime)
-	_, err := ws.DB.Exec(query, dateTimeExpires, temp, id)
+func (ws *WeatherService) UpdateLocation(ctx context.Context, id int, conditions *Conditions) error {
+	_, err := ws.DB.ExecContext(ctx, updateConditionsQuery+` WHERE id = ?`, append(updateConditionsArgs(conditions), id)...)
 	if err != nil {
 		ws.Logger.Error("Failed to update location", slog.Int("id", id), slog.String("error", err.Error()))
 		return err
@@ -125,9 +246,75 @@ func (ws *WeatherService) UpdateLocation(id int, temp float64) error {
 	return nil
 }
 
-func (ws *WeatherService) DeleteLocation(id int) error {
-	query := `DELETE FROM locations WHERE id = ?`
-	result, err := ws.DB.Exec(query, id)
+// UpdateLocationsAt stores the conditions for every user's location at the
+// coordinates, so one API call refreshes them all, and returns their ids.
+// It's one statement, so they're all updated or none are.
+func (ws *WeatherService) UpdateLocationsAt(ctx context.Context, latitude, longitude float64, conditions *Conditions) ([]int, error) {
+	rows, err := ws.DB.QueryContext(ctx, updateConditionsQuery+` WHERE latitude = ? AND longitude = ? AND provider != 'station' RETURNING id`,
+		append(updateConditionsArgs(conditions), latitude, longitude)...)
+	if err != nil {
+		ws.Logger.Error("Failed to update locations at coordinates", slog.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]int, 0)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			ws.Logger.Error("Failed to scan location id", slog.String("error", err.Error()))
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		ws.Logger.Error("Error updating locations at coordinates", slog.String("error", err.Error()))
+		return nil, err
+	}
+	ws.Logger.Info("Locations updated successfully", slog.Float64("latitude", latitude), slog.Float64("longitude", longitude),
+		slog.Int("count", len(ids)))
+	return ids, nil
+}
+
+// updateConditionsQuery stores what updateConditionsArgs returns, readings
+// are stored in Celsius and m/s, the units are recorded next to them
+const updateConditionsQuery = `UPDATE locations SET expires = ?, temp = ?, feels_like = ?, temp_unit = ?, humidity = ?,
+	pressure = ?, wind_speed = ?, wind_unit = ?, observed_at = ?, claimed_until = ''`
+
+func updateConditionsArgs(conditions *Conditions) []any {
+	return []any{time.Now().Add(30 * time.Minute).Format(time.DateTime), conditions.Temperature.Celsius(),
+		conditions.FeelsLike.Celsius(), units.Celsius, conditions.Humidity, conditions.Pressure, conditions.WindSpeed,
+		units.MetersPerSecond, conditions.Observed.Format(time.DateTime)}
+}
+
+// ClaimExpired marks the expired locations at the coordinates as being
+// refreshed for the next d, it's false when there's nothing to refresh or
+// someone else already claimed them. UpdateLocationsAt ends the claim.
+func (ws *WeatherService) ClaimExpired(ctx context.Context, latitude, longitude float64, d time.Duration) (bool, error) {
+	now := time.Now()
+	result, err := ws.DB.ExecContext(ctx, `UPDATE locations SET claimed_until = ?
+		WHERE latitude = ? AND longitude = ? AND expires < ? AND claimed_until < ? AND provider != 'station'`,
+		now.Add(d).Format(time.DateTime), latitude, longitude, now.Format(time.DateTime), now.Format(time.DateTime))
+	if err != nil {
+		ws.Logger.Error("Failed to claim expired locations", slog.String("error", err.Error()))
+		return false, err
+	}
+	claimed, err := result.RowsAffected()
+	return claimed > 0, err
+}
+
+// ReleaseClaim lets the locations at the coordinates be refreshed again
+// after a failed refresh.
+func (ws *WeatherService) ReleaseClaim(ctx context.Context, latitude, longitude float64) error {
+	_, err := ws.DB.ExecContext(ctx, `UPDATE locations SET claimed_until = '' WHERE latitude = ? AND longitude = ?`, latitude, longitude)
+	if err != nil {
+		ws.Logger.Error("Failed to release claim on locations", slog.String("error", err.Error()))
+	}
+	return err
+}
+
+// DeleteLocation deletes one of the user's locations.
+func (ws *WeatherService) DeleteLocation(ctx context.Context, userID, id int) error {
+	result, err := ws.DB.ExecContext(ctx, `DELETE FROM locations WHERE id = ? AND user_id = ?`, id, userID)
 	if err != nil {
 		ws.Logger.Error("Failed to delete location", slog.Int("id", id), slog.String("error", err.Error()))
 		return err
@@ -138,8 +325,18 @@ func (ws *WeatherService) DeleteLocation(id int) error {
 		return err
 	}
 	if rowsAffected == 0 {
-		ws.Logger.Warn("No location found to delete", slog.Int("id", id))
-		return fmt.Errorf("no location found with id %d", id)
+		ws.Logger.Warn("No location found to delete", slog.Int("id", id), slog.Int("user_id", userID))
+		return fmt.Errorf("%w with id %d", ErrLocationNotFound, id)
+	}
+	if _, err := ws.DB.ExecContext(ctx, `DELETE FROM alerts WHERE location_id = ?`, id); err != nil {
+		ws.Logger.Error("Failed to delete location alerts", slog.Int("id", id), slog.String("error", err.Error()))
+		return err
+	}
+	// rule state is shared by the locations at the same coordinates
+	if _, err := ws.DB.ExecContext(ctx, `DELETE FROM rule_state WHERE NOT EXISTS
+		(SELECT 1 FROM locations l WHERE l.latitude = rule_state.latitude AND l.longitude = rule_state.longitude)`); err != nil {
+		ws.Logger.Error("Failed to delete location rule state", slog.Int("id", id), slog.String("error", err.Error()))
+		return err
 	}
 	ws.Logger.Info("Location deleted successfully", slog.Int("id", id))
 	return nil
@@ -0,0 +1,180 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pressly/goose/v3"
+)
+
+// openTestDB is a migrated database that's removed after the test.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "w.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	goose.SetLogger(goose.NopLogger())
+	if err := goose.SetDialect("sqlite3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := goose.Up(db, "../migrations"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestWeatherServiceCanceled(t *testing.T) {
+	ws := &WeatherService{DB: openTestDB(t), Logger: testLogger()}
+	if _, err := ws.SaveLocation(context.Background(), 1, "Munich", "Bavaria", "DE", 48.1, 11.5, nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ws.GetAll(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetAll error = %v, want context.Canceled", err)
+	}
+	if _, err := ws.GetAllExpired(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetAllExpired error = %v, want context.Canceled", err)
+	}
+	if _, err := ws.SaveLocation(ctx, 1, "Paris", "", "FR", 48.9, 2.4, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("SaveLocation error = %v, want context.Canceled", err)
+	}
+	locations, err := ws.GetAll(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 1 {
+		t.Errorf("got %d locations, want only Munich saved", len(locations))
+	}
+}
+
+func TestStationsSharedByUsers(t *testing.T) {
+	ws := &WeatherService{DB: openTestDB(t), Logger: testLogger()}
+	ctx := context.Background()
+	id, err := ws.SaveStation(ctx, Station{ID: "KMNBACK1", Password: "station-key", Name: "Backyard", Country: "US"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ws.SaveLocation(ctx, 2, "Duluth", "MN", "US", 46.78, -92.1, nil); err != nil {
+		t.Fatal(err)
+	}
+	for userID := 1; userID <= 2; userID++ {
+		locations, err := ws.GetAll(ctx, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, location := range locations {
+			found = found || location.ID == id
+		}
+		if !found {
+			t.Errorf("user %d doesn't see the station", userID)
+		}
+		if err := ws.DeleteLocation(ctx, userID, id); !errors.Is(err, ErrLocationNotFound) {
+			t.Errorf("user %d deleting the station: %v", userID, err)
+		}
+	}
+	locations, err := ws.GetAll(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 1 {
+		t.Errorf("user 1 sees %d locations, want only the station", len(locations))
+	}
+}
+
+func TestClaimExpired(t *testing.T) {
+	ws := &WeatherService{DB: openTestDB(t), Logger: testLogger()}
+	ctx := context.Background()
+	for userID := 1; userID <= 2; userID++ {
+		if _, err := ws.SaveLocation(ctx, userID, "Duluth", "MN", "US", 46.78, -92.1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	claim := func(what string, want bool) {
+		t.Helper()
+		claimed, err := ws.ClaimExpired(ctx, 46.78, -92.1, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed != want {
+			t.Errorf("%s: claimed = %v, want %v", what, claimed, want)
+		}
+	}
+	claim("first claim", true)
+	claim("while claimed", false)
+	if err := ws.ReleaseClaim(ctx, 46.78, -92.1); err != nil {
+		t.Fatal(err)
+	}
+	claim("after release", true)
+	claim("while claimed", false)
+	// as if the server holding the claim crashed and it ran out
+	if _, err := ws.DB.Exec(`UPDATE locations SET claimed_until = ?`, time.Now().Add(-time.Second).Format(time.DateTime)); err != nil {
+		t.Fatal(err)
+	}
+	claim("after the claim ran out", true)
+	expired, err := ws.GetAllExpired(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 0 {
+		t.Errorf("claimed locations are still listed as expired: %v", expired)
+	}
+}
+
+func TestWeatherServiceWritesAllOrNothing(t *testing.T) {
+	ws := &WeatherService{DB: openTestDB(t), Logger: testLogger()}
+	ctx := context.Background()
+	id, err := ws.SaveLocation(ctx, 1, "Duluth", "MN", "US", 46.78, -92.1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ws.UpdateLocationsAt(ctx, 46.78, -92.1, &Conditions{Observed: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	storm := Alert{Sender: "NWS Duluth", Event: "Winter Storm Warning", Start: time.Now(), End: time.Now().Add(time.Hour)}
+	if _, err := ws.SaveAlerts(ctx, id, []Alert{storm}); err != nil {
+		t.Fatal(err)
+	}
+
+	// sharing the alert with a second user's copy fails
+	if _, err := ws.DB.Exec(`CREATE TRIGGER fail_alerts BEFORE INSERT ON alerts BEGIN SELECT RAISE(ABORT, 'disk full'); END`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ws.SaveLocation(ctx, 2, "Duluth", "MN", "US", 46.78, -92.1, nil); err == nil {
+		t.Error("SaveLocation succeeded without the shared conditions")
+	}
+	if locations, err := ws.GetAll(ctx, 2); err != nil || len(locations) != 0 {
+		t.Errorf("after a failed save the user has %v, %v", locations, err)
+	}
+	if _, err := ws.DB.Exec(`DROP TRIGGER fail_alerts`); err != nil {
+		t.Fatal(err)
+	}
+	second, err := ws.SaveLocation(ctx, 2, "Duluth", "MN", "US", 46.78, -92.1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second copy can't be updated, the first mustn't be either
+	if _, err := ws.DB.Exec(`UPDATE locations SET expires = '' WHERE id IN (?, ?)`, id, second); err != nil {
+		t.Fatal(err)
+	}
+	trigger := fmt.Sprintf(`CREATE TRIGGER fail_update BEFORE UPDATE ON locations WHEN NEW.id = %d BEGIN SELECT RAISE(ABORT, 'disk full'); END`, second)
+	if _, err := ws.DB.Exec(trigger); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ws.UpdateLocationsAt(ctx, 46.78, -92.1, &Conditions{Observed: time.Now()}); err == nil {
+		t.Error("UpdateLocationsAt succeeded with a location not updated")
+	}
+	if expired, err := ws.GetAllExpired(ctx, 1); err != nil || len(expired) != 1 {
+		t.Errorf("the first location was updated without the second: %v, %v", expired, err)
+	}
+}
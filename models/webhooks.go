@@ -0,0 +1,296 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Webhook is a URL told about every refreshed location.
+type Webhook struct {
+	Name string
+	URL  string
+	// Secret signs the body, receivers check X-Weather-Signature with it
+	Secret      string
+	MaxAttempts int
+}
+
+const (
+	deliveryPending   = "pending"
+	deliveryRetrying  = "retrying"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// deliveries older than this are deleted
+const deliveryRetention = 30 * 24 * time.Hour
+
+// WebhookDelivery is one attempt, with its retries, to POST a refresh to a webhook.
+type WebhookDelivery struct {
+	ID           int
+	Webhook      string
+	LocationID   int
+	Status       string
+	Attempts     int
+	ResponseCode int
+	Error        string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// WebhookPayload is the JSON body POSTed to webhooks. Temperatures are in
+// Celsius, pressure in hPa and wind speed in m/s.
+type WebhookPayload struct {
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"timestamp"`
+	Location  struct {
+		ID        int     `json:"id"`
+		City      string  `json:"city"`
+		State     string  `json:"state"`
+		Country   string  `json:"country"`
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+	} `json:"location"`
+	Conditions struct {
+		Temperature float64   `json:"temperature"`
+		FeelsLike   float64   `json:"feelsLike"`
+		Humidity    float64   `json:"humidity"`
+		Pressure    float64   `json:"pressure"`
+		WindSpeed   float64   `json:"windSpeed"`
+		ObservedAt  time.Time `json:"observedAt"`
+	} `json:"conditions"`
+	NewAlerts []WebhookAlert `json:"newAlerts"`
+}
+
+type WebhookAlert struct {
+	Sender      string    `json:"sender"`
+	Event       string    `json:"event"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Description string    `json:"description"`
+}
+
+// WebhookDispatcher POSTs every refresh to the webhooks in the background,
+// retrying failures with exponential backoff, and logs each delivery.
+type WebhookDispatcher struct {
+	DB       *sql.DB
+	Logger   *slog.Logger
+	Webhooks []Webhook
+	// RetryDelay is the wait before the first retry, it doubles after each one
+	RetryDelay time.Duration
+	// Shutdown is cancelled when the server stops, deliveries in progress give
+	// up then. Deliveries outlive the refresh that started them otherwise.
+	Shutdown context.Context
+
+	wg sync.WaitGroup
+}
+
+func (wd *WebhookDispatcher) LocationRefreshed(ctx context.Context, location *Location, newAlerts []Alert) {
+	if len(wd.Webhooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(newWebhookPayload(location, newAlerts, time.Now()))
+	if err != nil {
+		wd.Logger.Error("Failed to encode webhook payload", slog.Int("location_id", location.ID), slog.String("error", err.Error()))
+		return
+	}
+	wd.pruneDeliveries(ctx)
+	for _, webhook := range wd.Webhooks {
+		id, err := wd.createDelivery(ctx, webhook, location.ID)
+		if err != nil {
+			continue
+		}
+		wd.wg.Add(1)
+		go func() {
+			defer wd.wg.Done()
+			wd.deliver(wd.shutdown(), webhook, id, body)
+		}()
+	}
+}
+
+// Wait waits for the deliveries in progress, call it after Shutdown is
+// cancelled so they get to record that they gave up.
+func (wd *WebhookDispatcher) Wait() {
+	wd.wg.Wait()
+}
+
+func (wd *WebhookDispatcher) shutdown() context.Context {
+	if wd.Shutdown == nil {
+		return context.Background()
+	}
+	return wd.Shutdown
+}
+
+func newWebhookPayload(location *Location, newAlerts []Alert, now time.Time) *WebhookPayload {
+	payload := &WebhookPayload{Event: "location.refreshed", Timestamp: now.UTC(), NewAlerts: make([]WebhookAlert, 0)}
+	payload.Location.ID = location.ID
+	payload.Location.City = location.City
+	payload.Location.State = location.State
+	payload.Location.Country = location.Country
+	payload.Location.Latitude = location.Latitude
+	payload.Location.Longitude = location.Longitude
+	payload.Conditions.Temperature = location.Temperature.Celsius()
+	payload.Conditions.FeelsLike = location.FeelsLike.Celsius()
+	payload.Conditions.Humidity = location.Humidity
+	payload.Conditions.Pressure = location.Pressure
+	payload.Conditions.WindSpeed = location.WindSpeed
+	payload.Conditions.ObservedAt = location.ObservedAt.UTC()
+	for _, alert := range newAlerts {
+		payload.NewAlerts = append(payload.NewAlerts, WebhookAlert{Sender: alert.Sender, Event: alert.Event,
+			Start: alert.Start.UTC(), End: alert.End.UTC(), Description: alert.Description})
+	}
+	return payload
+}
+
+// SignWebhook is the X-Weather-Signature header for a body sent at timestamp,
+// an HMAC-SHA256 of "<timestamp>.<body>" so an old delivery can't be replayed.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wd *WebhookDispatcher) deliver(ctx context.Context, webhook Webhook, id int64, body []byte) {
+	maxAttempts := webhook.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+	delay := wd.RetryDelay
+	if delay <= 0 {
+		delay = 2 * time.Second
+	}
+	// the outcome is recorded even when the delivery stopped for shutdown
+	final := context.WithoutCancel(ctx)
+	for attempt := 1; ; attempt++ {
+		code, err := wd.post(ctx, webhook, id, body)
+		if err == nil {
+			wd.updateDelivery(final, id, deliveryDelivered, attempt, code, "")
+			wd.Logger.Info("Webhook delivered", slog.String("webhook", webhook.Name), slog.Int64("delivery", id),
+				slog.Int("attempts", attempt))
+			return
+		}
+		if ctx.Err() != nil {
+			wd.stopped(final, webhook, id, attempt, code, ctx.Err())
+			return
+		}
+		// a receiver rejecting the request won't change its mind, except when
+		// it's busy or timed out
+		retry := code < 400 || code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+		if attempt >= maxAttempts || !retry {
+			wd.updateDelivery(final, id, deliveryFailed, attempt, code, err.Error())
+			wd.Logger.Error("Webhook delivery failed", slog.String("webhook", webhook.Name), slog.Int64("delivery", id),
+				slog.Int("attempts", attempt), slog.String("error", err.Error()))
+			return
+		}
+		wd.updateDelivery(ctx, id, deliveryRetrying, attempt, code, err.Error())
+		wd.Logger.Warn("Webhook delivery will be retried", slog.String("webhook", webhook.Name), slog.Int64("delivery", id),
+			slog.Int("attempts", attempt), slog.Duration("delay", delay), slog.String("error", err.Error()))
+		select {
+		case <-ctx.Done():
+			wd.stopped(final, webhook, id, attempt, code, ctx.Err())
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// stopped records a delivery given up because the server is stopping.
+func (wd *WebhookDispatcher) stopped(ctx context.Context, webhook Webhook, id int64, attempts, code int, err error) {
+	wd.updateDelivery(ctx, id, deliveryFailed, attempts, code, "stopped by shutdown: "+err.Error())
+	wd.Logger.Warn("Webhook delivery stopped by shutdown", slog.String("webhook", webhook.Name), slog.Int64("delivery", id),
+		slog.Int("attempts", attempts))
+}
+
+// post sends the body once and returns the response status code, 0 when
+// there was no response.
+func (wd *WebhookDispatcher) post(ctx context.Context, webhook Webhook, id int64, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Weather-Event", "location.refreshed")
+	req.Header.Set("X-Weather-Delivery", strconv.FormatInt(id, 10))
+	req.Header.Set("X-Weather-Timestamp", strconv.FormatInt(timestamp, 10))
+	if webhook.Secret != "" {
+		req.Header.Set("X-Weather-Signature", SignWebhook(webhook.Secret, timestamp, body))
+	}
+	resp, err := deliveryClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("%s responded with status %s", req.URL.Host, resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (wd *WebhookDispatcher) createDelivery(ctx context.Context, webhook Webhook, locationID int) (int64, error) {
+	now := time.Now().Format(time.DateTime)
+	result, err := wd.DB.ExecContext(ctx, `INSERT INTO webhook_deliveries (webhook, location_id, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`,
+		webhook.Name, locationID, deliveryPending, now, now)
+	if err != nil {
+		wd.Logger.Error("Failed to log webhook delivery", slog.String("webhook", webhook.Name), slog.String("error", err.Error()))
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (wd *WebhookDispatcher) updateDelivery(ctx context.Context, id int64, status string, attempts, responseCode int, deliveryErr string) {
+	_, err := wd.DB.ExecContext(ctx, `UPDATE webhook_deliveries SET status = ?, attempts = ?, response_code = ?, error = ?, updated_at = ? WHERE id = ?`,
+		status, attempts, responseCode, deliveryErr, time.Now().Format(time.DateTime), id)
+	if err != nil {
+		wd.Logger.Error("Failed to update webhook delivery", slog.Int64("delivery", id), slog.String("error", err.Error()))
+	}
+}
+
+func (wd *WebhookDispatcher) pruneDeliveries(ctx context.Context) {
+	cutoff := time.Now().Add(-deliveryRetention).Format(time.DateTime)
+	if _, err := wd.DB.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE created_at < ?`, cutoff); err != nil {
+		wd.Logger.Warn("Failed to prune webhook deliveries", slog.String("error", err.Error()))
+	}
+}
+
+// Deliveries returns the most recent deliveries, newest first.
+func (wd *WebhookDispatcher) Deliveries(ctx context.Context, limit int) ([]WebhookDelivery, error) {
+	rows, err := wd.DB.QueryContext(ctx, `SELECT id, webhook, location_id, status, attempts, response_code, error, created_at, updated_at
+		FROM webhook_deliveries ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		wd.Logger.Error("Failed to get webhook deliveries", slog.String("error", err.Error()))
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var createdAt, updatedAt string
+		err := rows.Scan(&delivery.ID, &delivery.Webhook, &delivery.LocationID, &delivery.Status, &delivery.Attempts,
+			&delivery.ResponseCode, &delivery.Error, &createdAt, &updatedAt)
+		if err != nil {
+			wd.Logger.Error("Failed to scan webhook delivery row", slog.String("error", err.Error()))
+			return nil, err
+		}
+		delivery.CreatedAt, _ = time.ParseInLocation(time.DateTime, createdAt, time.Local)
+		delivery.UpdatedAt, _ = time.ParseInLocation(time.DateTime, updatedAt, time.Local)
+		deliveries = append(deliveries, delivery)
+	}
+	if err = rows.Err(); err != nil {
+		wd.Logger.Error("Error iterating over webhook delivery rows", slog.String("error", err.Error()))
+		return nil, err
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDispatcher(t *testing.T, url string, shutdown context.Context) *WebhookDispatcher {
+	t.Helper()
+	return &WebhookDispatcher{DB: openTestDB(t), Logger: testLogger(), Shutdown: shutdown, RetryDelay: time.Hour,
+		Webhooks: []Webhook{{Name: "test", URL: url, Secret: "shared-secret", MaxAttempts: 3}}}
+}
+
+func lastDelivery(t *testing.T, wd *WebhookDispatcher) WebhookDelivery {
+	t.Helper()
+	deliveries, err := wd.Deliveries(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(deliveries))
+	}
+	return deliveries[0]
+}
+
+func TestWebhookDelivered(t *testing.T) {
+	var signature, timestamp string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("X-Weather-Signature")
+		timestamp = r.Header.Get("X-Weather-Timestamp")
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	wd := testDispatcher(t, server.URL, context.Background())
+
+	wd.LocationRefreshed(context.Background(), testLocation(), nil)
+	wd.Wait()
+
+	delivery := lastDelivery(t, wd)
+	if delivery.Status != deliveryDelivered || delivery.Attempts != 1 || delivery.ResponseCode != http.StatusNoContent {
+		t.Errorf("delivery = %+v", delivery)
+	}
+	if !strings.Contains(string(body), `"city":"Duluth"`) {
+		t.Errorf("body = %s", body)
+	}
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := SignWebhook("shared-secret", sent, body); signature != want {
+		t.Errorf("signature = %q, want %q", signature, want)
+	}
+}
+
+func TestWebhookShutdownCutsOffPost(t *testing.T) {
+	shutdown, stop := context.WithCancel(context.Background())
+	wd := testDispatcher(t, blockingServer(t).URL, shutdown)
+
+	wd.LocationRefreshed(context.Background(), testLocation(), nil)
+	time.AfterFunc(50*time.Millisecond, stop)
+	start := time.Now()
+	wd.Wait()
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("delivery took %v to stop", took)
+	}
+
+	delivery := lastDelivery(t, wd)
+	if delivery.Status != deliveryFailed || delivery.Attempts != 1 || !strings.Contains(delivery.Error, "shutdown") {
+		t.Errorf("delivery = %+v", delivery)
+	}
+}
+
+func TestWebhookShutdownStopsRetries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	shutdown, stop := context.WithCancel(context.Background())
+	wd := testDispatcher(t, server.URL, shutdown)
+
+	wd.LocationRefreshed(context.Background(), testLocation(), nil)
+	eventually(t, "the first attempt", func() bool { return lastDelivery(t, wd).Status == deliveryRetrying })
+	stop()
+	// RetryDelay is an hour, only shutdown ends the wait
+	wd.Wait()
+
+	delivery := lastDelivery(t, wd)
+	if delivery.Status != deliveryFailed || delivery.Attempts != 1 || delivery.ResponseCode != http.StatusServiceUnavailable ||
+		!strings.Contains(delivery.Error, "shutdown") {
+		t.Errorf("delivery = %+v", delivery)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/daniel-z-johnson/personal-weather/config"
+	"github.com/daniel-z-johnson/personal-weather/models"
+	"github.com/daniel-z-johnson/personal-weather/units"
+)
+
+// newNotifier builds the notification sinks and rules from the config,
+// rejecting anything it doesn't understand.
+func newNotifier(conf *config.Config, db *sql.DB, logger *slog.Logger) (*models.Notifier, error) {
+	notifier := &models.Notifier{
+		Logger:    logger,
+		Sinks:     make(map[string]models.NotificationSink),
+		Evaluator: &models.RuleEvaluator{DB: db, Logger: logger},
+	}
+	for _, sink := range conf.Notifications.Sinks {
+		if _, ok := notifier.Sinks[sink.Name]; ok || sink.Name == "" {
+			return nil, fmt.Errorf("notification sinks need unique names, got %q", sink.Name)
+		}
+		switch sink.Type {
+		case "smtp":
+			port := sink.Port
+			if port == 0 {
+				port = 587
+			}
+			notifier.Sinks[sink.Name] = &models.SMTPSink{SinkName: sink.Name, Host: sink.Host, Port: port,
+				Username: sink.Username, Password: sink.Password, From: sink.From, To: sink.To}
+		case "webhook":
+			notifier.Sinks[sink.Name] = &models.WebhookSink{SinkName: sink.Name, URL: sink.URL, Headers: sink.Headers}
+		case models.PushNtfy, models.PushGotify:
+			notifier.Sinks[sink.Name] = &models.PushSink{SinkName: sink.Name, Kind: sink.Type, URL: sink.URL,
+				Token: sink.Token, Priority: sink.Priority}
+		default:
+			return nil, fmt.Errorf("notification sink %q has unknown type %q", sink.Name, sink.Type)
+		}
+	}
+	names := make(map[string]bool)
+	for _, ruleConf := range conf.Notifications.Rules {
+		if names[ruleConf.Name] || ruleConf.Name == "" {
+			// rule state is saved by name
+			return nil, fmt.Errorf("notification rules need unique names, got %q", ruleConf.Name)
+		}
+		names[ruleConf.Name] = true
+		rule, err := newNotificationRule(ruleConf)
+		if err != nil {
+			return nil, fmt.Errorf("notification rule %q: %w", ruleConf.Name, err)
+		}
+		for _, sink := range rule.Sinks {
+			if _, ok := notifier.Sinks[sink]; !ok {
+				return nil, fmt.Errorf("notification rule %q uses unknown sink %q", rule.Name, sink)
+			}
+		}
+		notifier.Rules = append(notifier.Rules, rule)
+	}
+	return notifier, nil
+}
+
+func newNotificationRule(ruleConf config.NotificationRule) (models.NotificationRule, error) {
+	rule := models.NotificationRule{
+		Name:        ruleConf.Name,
+		Kind:        ruleConf.Type,
+		Location:    ruleConf.Location,
+		Sinks:       ruleConf.Sinks,
+		MinInterval: ruleConf.MinInterval.Duration,
+	}
+	if rule.MinInterval == 0 {
+		rule.MinInterval = time.Hour
+	}
+	quietHours, err := models.ParseQuietHours(ruleConf.QuietHours.Start, ruleConf.QuietHours.End)
+	if err != nil {
+		return rule, err
+	}
+	rule.QuietHours = quietHours
+	switch ruleConf.Type {
+	case models.RuleAlert:
+		return rule, nil
+	case "temperature_below":
+		rule.Kind = models.RuleThreshold
+		ruleConf.Metric = models.MetricTemperature
+		ruleConf.Operator = "<"
+	case "temperature_above":
+		rule.Kind = models.RuleThreshold
+		ruleConf.Metric = models.MetricTemperature
+		ruleConf.Operator = ">"
+	case models.RuleThreshold:
+	default:
+		return rule, fmt.Errorf("unknown type %q", ruleConf.Type)
+	}
+	if !slices.Contains(models.Metrics, ruleConf.Metric) {
+		return rule, fmt.Errorf("unknown metric %q", ruleConf.Metric)
+	}
+	if !slices.Contains(models.Operators, ruleConf.Operator) {
+		return rule, fmt.Errorf("unknown operator %q", ruleConf.Operator)
+	}
+	threshold, hysteresis, err := storedUnits(ruleConf.Metric, ruleConf.Unit, ruleConf.Threshold, ruleConf.Hysteresis)
+	if err != nil {
+		return rule, err
+	}
+	rule.Condition = models.ThresholdCondition{
+		Metric:     ruleConf.Metric,
+		Operator:   ruleConf.Operator,
+		Threshold:  threshold,
+		Hysteresis: hysteresis,
+		For:        ruleConf.For.Duration,
+	}
+	return rule, nil
+}
+
+// storedUnits converts a threshold and hysteresis from the unit written in the
+// config to the unit the metric is stored in.
+func storedUnits(metric, unit string, threshold, hysteresis float64) (float64, float64, error) {
+	switch metric {
+	case models.MetricTemperature, models.MetricFeelsLike:
+		if unit == "" {
+			unit = string(units.Fahrenheit)
+		}
+		t, err := units.NewTemperature(threshold, units.TemperatureUnit(unit))
+		if err != nil {
+			return 0, 0, err
+		}
+		// hysteresis is a difference, only its scale changes
+		if unit == string(units.Fahrenheit) {
+			hysteresis = hysteresis * 5 / 9
+		}
+		return t.Celsius(), hysteresis, nil
+	case models.MetricWindSpeed:
+		if unit == "" {
+			unit = string(units.MilesPerHour)
+		}
+		if !slices.Contains(units.SpeedUnits, units.SpeedUnit(unit)) {
+			return 0, 0, fmt.Errorf("unknown wind speed unit %q", unit)
+		}
+		return units.ConvertSpeed(threshold, units.SpeedUnit(unit), units.MetersPerSecond),
+			units.ConvertSpeed(hysteresis, units.SpeedUnit(unit), units.MetersPerSecond), nil
+	case models.MetricPressure:
+		if unit == "" {
+			unit = string(units.Hectopascals)
+		}
+		if !slices.Contains(units.PressureUnits, units.PressureUnit(unit)) {
+			return 0, 0, fmt.Errorf("unknown pressure unit %q", unit)
+		}
+		return units.ConvertPressure(threshold, units.PressureUnit(unit), units.Hectopascals),
+			units.ConvertPressure(hysteresis, units.PressureUnit(unit), units.Hectopascals), nil
+	}
+	return threshold, hysteresis, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/daniel-z-johnson/personal-weather/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+// serve runs the app over HTTP, or over HTTPS when TLS is configured, until
+// ctx is cancelled. Requests' contexts are cancelled then too, so refreshes
+// stop, and requests get a few seconds to finish.
+func serve(ctx context.Context, conf config.Server, handler http.Handler, logger *slog.Logger) error {
+	baseContext := func(net.Listener) context.Context { return ctx }
+	if !conf.TLS.Enabled() {
+		server := &http.Server{Addr: conf.Addr, Handler: handler, BaseContext: baseContext}
+		logger.Info("Serving HTTP", slog.String("addr", conf.Addr))
+		return run(ctx, server, logger, server.ListenAndServe)
+	}
+	server := &http.Server{Addr: conf.TLS.Addr, Handler: handler, BaseContext: baseContext}
+	redirect := redirectToHTTPS(conf.TLS.Addr)
+	if len(conf.TLS.ACME.Domains) > 0 {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(conf.TLS.ACME.Domains...),
+			Cache:      autocert.DirCache(conf.TLS.ACME.CacheDir),
+			Email:      conf.TLS.ACME.Email,
+		}
+		if conf.TLS.ACME.DirectoryURL != "" {
+			manager.Client = &acme.Client{DirectoryURL: conf.TLS.ACME.DirectoryURL}
+		}
+		// TLSConfig answers TLS-ALPN challenges on the HTTPS port, HTTPHandler
+		// answers HTTP challenges on the redirect port
+		server.TLSConfig = manager.TLSConfig()
+		redirect = manager.HTTPHandler(redirect)
+		logger.Info("Serving HTTPS with ACME certificates", slog.String("addr", conf.TLS.Addr),
+			slog.Any("domains", conf.TLS.ACME.Domains))
+	} else {
+		certs := &certReloader{certFile: conf.TLS.CertFile, keyFile: conf.TLS.KeyFile, logger: logger}
+		if _, err := certs.GetCertificate(nil); err != nil {
+			return err
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+		logger.Info("Serving HTTPS", slog.String("addr", conf.TLS.Addr), slog.String("cert", conf.TLS.CertFile))
+	}
+	if conf.TLS.RedirectAddr != "" {
+		go func() {
+			logger.Info("Redirecting HTTP to HTTPS", slog.String("addr", conf.TLS.RedirectAddr))
+			redirectServer := &http.Server{Addr: conf.TLS.RedirectAddr, Handler: redirect, ReadHeaderTimeout: 10 * time.Second}
+			if err := run(ctx, redirectServer, logger, redirectServer.ListenAndServe); err != nil {
+				logger.Error("HTTP redirect server stopped", slog.Any("error", err))
+			}
+		}()
+	}
+	return run(ctx, server, logger, func() error {
+		// the certificates come from TLSConfig
+		return server.ListenAndServeTLS("", "")
+	})
+}
+
+// run calls listen and shuts the server down once ctx is cancelled, giving
+// open requests shutdownTimeout to finish.
+func run(ctx context.Context, server *http.Server, logger *slog.Logger, listen func() error) error {
+	stopped := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		stopped <- server.Shutdown(shutdownCtx)
+	}()
+	if err := listen(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	if err := <-stopped; err != nil {
+		logger.Warn("Requests were cut off by shutdown", slog.String("addr", server.Addr), slog.Any("error", err))
+	}
+	return nil
+}
+
+// redirectToHTTPS sends requests to the same URL over HTTPS, keeping the port
+// when HTTPS isn't on the default one.
+func redirectToHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		// keeps the method and body
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
+
+// certReloader loads the certificate again when its file changes, so renewed
+// certificates are picked up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	info, err := os.Stat(cr.certFile)
+	if err != nil {
+		if cr.cert != nil {
+			// keep serving the old one while the file is being replaced
+			return cr.cert, nil
+		}
+		return nil, fmt.Errorf("reading TLS certificate: %w", err)
+	}
+	if cr.cert != nil && info.ModTime().Equal(cr.modTime) {
+		return cr.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		if cr.cert != nil {
+			cr.logger.Warn("Failed to reload TLS certificate", slog.String("cert", cr.certFile), slog.Any("error", err))
+			// try again when the file changes again
+			cr.modTime = info.ModTime()
+			return cr.cert, nil
+		}
+		return nil, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	if cr.cert != nil {
+		cr.logger.Info("Reloaded TLS certificate", slog.String("cert", cr.certFile))
+	}
+	cr.cert = &cert
+	cr.modTime = info.ModTime()
+	return cr.cert, nil
+}
@@ -0,0 +1,8 @@
+// Asks before submitting forms whose button has a data-confirm message, the
+// Content-Security-Policy doesn't allow inline handlers.
+document.addEventListener("click", function (event) {
+    var button = event.target.closest("[data-confirm]");
+    if (button && !window.confirm(button.dataset.confirm)) {
+        event.preventDefault();
+    }
+});
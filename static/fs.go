@@ -0,0 +1,66 @@
+package static
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// app.css is built from the classes used in the templates with the Tailwind
+// standalone CLI (https://tailwindcss.com/blog/standalone-cli), run
+// `go generate ./static` after changing them and commit the result.
+//go:generate tailwindcss -i input.css -o app.css --minify
+
+//go:embed app.css app.js
+var FS embed.FS
+
+// hashed maps each file to its name with a hash of its content, e.g.
+// "app.css" to "app.3f2a9c1b04d5.css", and names back to files.
+var hashed, files = hashNames()
+
+func hashNames() (map[string]string, map[string]string) {
+	hashed := make(map[string]string)
+	files := make(map[string]string)
+	entries, err := fs.ReadDir(FS, ".")
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		content, err := fs.ReadFile(FS, entry.Name())
+		if err != nil {
+			panic(err)
+		}
+		sum := sha256.Sum256(content)
+		ext := path.Ext(entry.Name())
+		name := strings.TrimSuffix(entry.Name(), ext) + "." + hex.EncodeToString(sum[:6]) + ext
+		hashed[entry.Name()] = name
+		files[name] = entry.Name()
+	}
+	return hashed, files
+}
+
+// Path is the URL of a static file, it changes whenever the file does so
+// browsers can cache it forever.
+func Path(name string) string {
+	return "/static/" + hashed[name]
+}
+
+// Handler serves the files under /static/ by their hashed names.
+func Handler() http.Handler {
+	fileServer := http.FileServerFS(FS)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, ok := files[strings.TrimPrefix(r.URL.Path, "/static/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = "/" + file
+		fileServer.ServeHTTP(w, r2)
+	})
+}
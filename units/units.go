@@ -0,0 +1,242 @@
+// Package units converts and formats weather measurements so every page and
+// the JSON API show the same numbers for the same preferences.
+package units
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+type TemperatureUnit string
+
+const (
+	Fahrenheit TemperatureUnit = "F"
+	Celsius    TemperatureUnit = "C"
+	Kelvin     TemperatureUnit = "K"
+	// BothTemperatures shows Fahrenheit and Celsius side by side
+	BothTemperatures TemperatureUnit = "both"
+)
+
+type SpeedUnit string
+
+const (
+	MilesPerHour      SpeedUnit = "mph"
+	KilometersPerHour SpeedUnit = "km/h"
+	MetersPerSecond   SpeedUnit = "m/s"
+	Knots             SpeedUnit = "kn"
+)
+
+type PressureUnit string
+
+const (
+	Hectopascals         PressureUnit = "hPa"
+	InchesOfMercury      PressureUnit = "inHg"
+	MillimetersOfMercury PressureUnit = "mmHg"
+)
+
+var TemperatureUnits = []TemperatureUnit{BothTemperatures, Fahrenheit, Celsius}
+var SpeedUnits = []SpeedUnit{MilesPerHour, KilometersPerHour, MetersPerSecond, Knots}
+var PressureUnits = []PressureUnit{Hectopascals, InchesOfMercury, MillimetersOfMercury}
+
+// meters per second in one of each speed unit
+var metersPerSecond = map[SpeedUnit]float64{
+	MilesPerHour:      0.44704,
+	KilometersPerHour: 1 / 3.6,
+	MetersPerSecond:   1,
+	Knots:             0.514444,
+}
+
+// hectopascals in one of each pressure unit
+var hectopascals = map[PressureUnit]float64{
+	Hectopascals:         1,
+	InchesOfMercury:      33.8639,
+	MillimetersOfMercury: 1.33322,
+}
+
+const absoluteZeroCelsius = -273.15
+
+// Temperature is a reading that knows its own unit, so it can't be shown as
+// °C when it was measured in °F. The zero value is 0 °C.
+type Temperature struct {
+	celsius float64
+}
+
+// NewTemperature reads value as a temperature in unit.
+func NewTemperature(value float64, unit TemperatureUnit) (Temperature, error) {
+	switch unit {
+	case Celsius:
+		return FromCelsius(value), nil
+	case Fahrenheit:
+		return FromFahrenheit(value), nil
+	case Kelvin:
+		return FromKelvin(value), nil
+	}
+	return Temperature{}, fmt.Errorf("unknown temperature unit %q", unit)
+}
+
+func FromCelsius(c float64) Temperature {
+	return Temperature{celsius: c}
+}
+
+func FromFahrenheit(f float64) Temperature {
+	return Temperature{celsius: (f - 32) * 5 / 9}
+}
+
+func FromKelvin(k float64) Temperature {
+	return Temperature{celsius: k + absoluteZeroCelsius}
+}
+
+func (t Temperature) Celsius() float64 {
+	return t.celsius
+}
+
+func (t Temperature) Fahrenheit() float64 {
+	return t.celsius*9/5 + 32
+}
+
+func (t Temperature) Kelvin() float64 {
+	return t.celsius - absoluteZeroCelsius
+}
+
+// In returns the temperature in unit, Celsius for anything unknown.
+func (t Temperature) In(unit TemperatureUnit) float64 {
+	switch unit {
+	case Fahrenheit:
+		return t.Fahrenheit()
+	case Kelvin:
+		return t.Kelvin()
+	}
+	return t.Celsius()
+}
+
+func ConvertSpeed(value float64, from, to SpeedUnit) float64 {
+	if from == to {
+		return value
+	}
+	return value * metersPerSecond[from] / metersPerSecond[to]
+}
+
+func ConvertPressure(value float64, from, to PressureUnit) float64 {
+	if from == to {
+		return value
+	}
+	return value * hectopascals[from] / hectopascals[to]
+}
+
+// Preferences are how a user wants measurements shown.
+type Preferences struct {
+	Temperature TemperatureUnit
+	Wind        SpeedUnit
+	Pressure    PressureUnit
+	Clock24     bool
+	// Precision is the number of decimal places, 0 to 2
+	Precision int
+}
+
+func DefaultPreferences() Preferences {
+	return Preferences{
+		Temperature: BothTemperatures,
+		Wind:        MilesPerHour,
+		Pressure:    Hectopascals,
+		Clock24:     false,
+		Precision:   0,
+	}
+}
+
+// ParsePreferences reads preferences from form or cookie values, anything
+// missing or unknown keeps its default.
+func ParsePreferences(values url.Values) Preferences {
+	prefs := DefaultPreferences()
+	if t := TemperatureUnit(values.Get("temperature")); slices.Contains(TemperatureUnits, t) {
+		prefs.Temperature = t
+	}
+	if s := SpeedUnit(values.Get("wind")); slices.Contains(SpeedUnits, s) {
+		prefs.Wind = s
+	}
+	if p := PressureUnit(values.Get("pressure")); slices.Contains(PressureUnits, p) {
+		prefs.Pressure = p
+	}
+	switch values.Get("clock") {
+	case "24":
+		prefs.Clock24 = true
+	case "12":
+		prefs.Clock24 = false
+	}
+	if precision, err := strconv.Atoi(values.Get("precision")); err == nil && precision >= 0 && precision <= 2 {
+		prefs.Precision = precision
+	}
+	return prefs
+}
+
+// Values is the inverse of ParsePreferences.
+func (p Preferences) Values() url.Values {
+	values := url.Values{}
+	values.Set("temperature", string(p.Temperature))
+	values.Set("wind", string(p.Wind))
+	values.Set("pressure", string(p.Pressure))
+	values.Set("clock", "12")
+	if p.Clock24 {
+		values.Set("clock", "24")
+	}
+	values.Set("precision", strconv.Itoa(p.Precision))
+	return values
+}
+
+// Round rounds value to the preferred number of decimal places.
+func (p Preferences) Round(value float64) float64 {
+	rounded, _ := strconv.ParseFloat(p.FormatNumber(value), 64)
+	return rounded
+}
+
+func (p Preferences) FormatNumber(value float64) string {
+	s := strconv.FormatFloat(value, 'f', p.Precision, 64)
+	if s == "-0" || s == "-0.0" || s == "-0.00" {
+		// a reading of -0.2 rounded to "-0" looks odd
+		return s[1:]
+	}
+	return s
+}
+
+// FormatTemperature shows t in the preferred unit.
+func (p Preferences) FormatTemperature(t Temperature) string {
+	f := p.FormatNumber(t.Fahrenheit())
+	c := p.FormatNumber(t.Celsius())
+	switch p.Temperature {
+	case Fahrenheit:
+		return f + "°F"
+	case Celsius:
+		return c + "°C"
+	default:
+		return f + "°F / " + c + "°C"
+	}
+}
+
+func (p Preferences) FormatWind(value float64, from SpeedUnit) string {
+	return p.FormatNumber(ConvertSpeed(value, from, p.Wind)) + " " + string(p.Wind)
+}
+
+func (p Preferences) FormatPressure(value float64, from PressureUnit) string {
+	return p.FormatNumber(ConvertPressure(value, from, p.Pressure)) + " " + string(p.Pressure)
+}
+
+func (p Preferences) FormatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	if p.Clock24 {
+		return t.Format("15:04")
+	}
+	return t.Format("3:04 PM")
+}
+
+// TemperatureUnit is the single unit used where both can't be shown, like the
+// JSON API.
+func (p Preferences) TemperatureUnit() TemperatureUnit {
+	if p.Temperature == Celsius {
+		return Celsius
+	}
+	return Fahrenheit
+}
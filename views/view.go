@@ -6,6 +6,10 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+
+	"github.com/daniel-z-johnson/personal-weather/context"
+	"github.com/daniel-z-johnson/personal-weather/models"
+	"github.com/daniel-z-johnson/personal-weather/static"
 )
 import "io/fs"
 
@@ -25,6 +29,9 @@ func (t Template) Execute(w http.ResponseWriter, r *http.Request, data any, erro
 		"errors": func() []error {
 			return errors
 		},
+		"currentUser": func() *models.User {
+			return context.User(r.Context())
+		},
 	})
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	var buf bytes.Buffer
@@ -52,6 +59,10 @@ func ParseFS(fs fs.FS, logger *slog.Logger, patterns ...string) (Template, error
 		"errors": func() []error {
 			return nil
 		},
+		"currentUser": func() *models.User {
+			return nil
+		},
+		"asset": static.Path,
 	})
 	tpl, err := tpl.ParseFS(fs, patterns...)
 	if err != nil {